@@ -0,0 +1,316 @@
+package helo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTP INSPECTION API
+//
+// GET    /api/messages?from=&to=&subject=  list messages, optionally filtered
+// DELETE /api/messages                     delete all messages
+// GET    /api/messages/{id}                message envelope and subject
+// GET    /api/messages/{id}/raw            message data as received
+// GET    /api/messages/{id}/parsed         decoded headers, bodies and attachments
+// DELETE /api/messages/{id}                delete a message
+// GET    /api/messages/{id}/parts          decoded mime leaf parts
+// GET    /api/messages/{id}/parts/{n}      content of the nth leaf part
+// GET    /api/messages/{id}/transcript     smtp transcript of the delivering session
+// GET    /api/search?q=                    messages containing q anywhere
+// GET    /api/events                       server-sent events of new messages
+// GET    /                                 web ui
+
+type (
+	apiHandler struct {
+		store *Store
+	}
+	apiMessage struct {
+		Envelope
+		Subject string `json:"subject"`
+	}
+	apiPart struct {
+		Index       int    `json:"index"`
+		ContentType string `json:"content_type"`
+		Charset     string `json:"charset,omitempty"`
+		Disposition string `json:"disposition,omitempty"`
+		Filename    string `json:"filename,omitempty"`
+		Size        int    `json:"size"`
+		Attachment  bool   `json:"attachment"`
+	}
+	apiParsedMessage struct {
+		apiMessage
+		Header      mail.Header  `json:"header"`
+		Text        string       `json:"text"`
+		HTML        string       `json:"html"`
+		Attachments []Attachment `json:"attachments"`
+	}
+)
+
+const (
+	api_event_buffer    = 64
+	api_event_keepalive = 15 * time.Second
+)
+
+// NewAPIHandler serves the inspection api for the messages in store.
+func NewAPIHandler(store *Store) http.Handler {
+	return &apiHandler{store}
+}
+
+// StartAPI serves the inspection api on host alongside the smtp
+// server, creating a store if none was set.  It is stopped by Stop.
+func (s *SmtpServer) StartAPI(host string) error {
+
+	if s.store == nil {
+		s.store = NewStore(0)
+	}
+
+	l, err := net.Listen("tcp", host)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("helo api listening", "addr", l.Addr().String())
+
+	s.api = &http.Server{Handler: NewAPIHandler(s.store)}
+
+	go func() {
+		if err := s.api.Serve(l); err != http.ErrServerClosed {
+			s.logger.Warn("api failed", "err", err)
+		}
+	}()
+
+	return nil
+
+}
+
+func (h *apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	path := strings.Trim(r.URL.Path, "/")
+
+	switch {
+	case path == "api/messages":
+		switch r.Method {
+		case "GET":
+			filter := MessageFilter{
+				From:    r.FormValue("from"),
+				To:      r.FormValue("to"),
+				Subject: r.FormValue("subject"),
+			}
+			writeJSON(w, summarize(h.store.Filter(filter)))
+		case "DELETE":
+			h.store.Clear()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+
+	case strings.HasPrefix(path, "api/messages/"):
+		h.serveMessage(w, r, strings.Split(strings.TrimPrefix(path, "api/messages/"), "/"))
+
+	case path == "api/search":
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.FormValue("q")
+		writeJSON(w, summarize(h.store.Find(func(m *Message) bool {
+			if containsFold(m.From, q) || containsFold(m.Data, q) {
+				return true
+			}
+			for _, to := range m.To {
+				if containsFold(to, q) {
+					return true
+				}
+			}
+			return false
+		})))
+
+	case path == "api/events":
+		h.serveEvents(w, r)
+
+	case !strings.HasPrefix(path, "api/"):
+		serveUI(w, r)
+
+	default:
+		http.NotFound(w, r)
+	}
+
+}
+
+func (h *apiHandler) serveMessage(w http.ResponseWriter, r *http.Request, parts []string) {
+
+	m, ok := h.store.Get(parts[0])
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var view, index string
+	if len(parts) > 1 {
+		view = parts[1]
+	}
+	if len(parts) > 2 {
+		index = parts[2]
+	}
+	if len(parts) > 3 || (len(index) > 0 && view != "parts") || (r.Method == "DELETE" && len(view) > 0) {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "DELETE":
+		h.store.Delete(m.ID)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch view {
+	case "":
+		writeJSON(w, summary(m))
+
+	case "raw":
+		w.Header().Set("Content-Type", "message/rfc822")
+		io.WriteString(w, m.Data)
+
+	case "parsed":
+		parsed, err := m.Parse()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		writeJSON(w, apiParsedMessage{summary(m), parsed.Header, parsed.Text, parsed.HTML, parsed.Attachments})
+
+	case "parts":
+		root, err := m.Parts()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		leaves := root.Leaves()
+
+		if len(index) == 0 {
+			infos := make([]apiPart, len(leaves))
+			for i, p := range leaves {
+				infos[i] = apiPart{i, p.ContentType, p.Params["charset"], p.Disposition, p.Filename, len(p.Body), p.IsAttachment()}
+			}
+			writeJSON(w, infos)
+			return
+		}
+
+		i, err := strconv.Atoi(index)
+		if err != nil || i < 0 || i >= len(leaves) {
+			http.NotFound(w, r)
+			return
+		}
+		servePart(w, leaves[i])
+
+	case "transcript":
+		writeJSON(w, m.Transcript.Entries())
+
+	default:
+		http.NotFound(w, r)
+	}
+
+}
+
+func (h *apiHandler) serveEvents(w http.ResponseWriter, r *http.Request) {
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	messages, cancel := h.store.Subscribe(api_event_buffer)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(api_event_keepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case m := <-messages:
+			data, err := json.Marshal(summary(m))
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "event: message\nid: %s\ndata: %s\n\n", m.ID, data)
+		case <-keepalive.C:
+			io.WriteString(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+
+}
+
+// servePart serves decoded part content.  Message content is never
+// trusted: it is sandboxed so html parts cannot run script or reach
+// the api, and attachments are always downloaded.
+func servePart(w http.ResponseWriter, p *Part) {
+
+	contentType, body := p.ContentType, p.Body
+
+	// text is always served as utf-8, unless its charset is unknown
+	if strings.HasPrefix(contentType, "text/") {
+		charset := "utf-8"
+		if text, err := p.Text(); err == nil {
+			body = []byte(text)
+		} else {
+			charset = p.Params["charset"]
+		}
+		contentType = mime.FormatMediaType(contentType, map[string]string{"charset": charset})
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if p.IsAttachment() {
+		filename := p.Filename
+		if len(filename) == 0 {
+			filename = "attachment"
+		}
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	}
+
+	w.Write(body)
+
+}
+
+func summary(m *Message) apiMessage {
+	return apiMessage{m.Envelope(), m.Subject()}
+}
+
+func summarize(messages []*Message) []apiMessage {
+	summaries := make([]apiMessage, 0, len(messages))
+	for _, m := range messages {
+		summaries = append(summaries, summary(m))
+	}
+	return summaries
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
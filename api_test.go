@@ -0,0 +1,187 @@
+package helo
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAPI(t *testing.T) {
+
+	store := NewStore(0)
+	store.Add(&Message{From: "a@example.org", To: []string{"x@example.net"}, Data: "Subject: first\r\n\r\nhello"})
+	store.Add(&Message{From: "b@example.org", To: []string{"y@example.net"}, Data: "Subject: second\r\n\r\nneedle"})
+
+	ts := httptest.NewServer(NewAPIHandler(store))
+	defer ts.Close()
+
+	get := func(path string, v interface{}) {
+		res, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: %s", path, res.Status)
+		}
+		if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var list []apiMessage
+	get("/api/messages?to=y@", &list)
+	if len(list) != 1 || list[0].ID != "2" || list[0].Subject != "second" {
+		t.Errorf("unexpected filtered list %+v", list)
+	}
+
+	get("/api/search?q=NEEDLE", &list)
+	if len(list) != 1 || list[0].ID != "2" {
+		t.Errorf("unexpected search result %+v", list)
+	}
+
+	var parsed apiParsedMessage
+	get("/api/messages/1/parsed", &parsed)
+	if parsed.Header.Get("Subject") != "first" || parsed.Text != "hello" || parsed.From != "a@example.org" {
+		t.Errorf("unexpected parsed message %+v", parsed)
+	}
+
+	res, err := http.Get(ts.URL + "/api/messages/1/raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(raw) != "Subject: first\r\n\r\nhello" {
+		t.Errorf("unexpected raw message %q", raw)
+	}
+
+	req, _ := http.NewRequest("DELETE", ts.URL+"/api/messages/1", nil)
+	if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected delete result %v %v", res, err)
+	}
+	if res, _ := http.Get(ts.URL + "/api/messages/1"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected deleted message to be gone, got %s", res.Status)
+	}
+
+}
+
+func TestAPIEvents(t *testing.T) {
+
+	store := NewStore(0)
+
+	ts := httptest.NewServer(NewAPIHandler(store))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/api/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	store.Add(&Message{From: "a@example.org", To: []string{"x@example.net"}, Data: "Subject: live\r\n\r\nhello"})
+
+	lines := bufio.NewReader(res.Body)
+	for {
+		line, err := lines.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "data: ") {
+			var m apiMessage
+			if err := json.Unmarshal([]byte(line[6:]), &m); err != nil {
+				t.Fatal(err)
+			}
+			if m.Subject != "live" {
+				t.Errorf("unexpected event %+v", m)
+			}
+			return
+		}
+	}
+
+}
+
+const (
+	TestMultipartMessage = "Subject: parts\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=outer\r\n" +
+		"\r\n" +
+		"--outer\r\n" +
+		"Content-Type: multipart/alternative; boundary=inner\r\n" +
+		"\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"caf=C3=A9\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"\r\n" +
+		"<p>cafe</p><script>alert(1)</script>\r\n" +
+		"--inner--\r\n" +
+		"--outer\r\n" +
+		"Content-Type: application/pdf; name=report.pdf\r\n" +
+		"Content-Disposition: attachment; filename=report.pdf\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"JVBERi0x\r\n" +
+		"LjQ=\r\n" +
+		"--outer--\r\n"
+)
+
+func TestAPIParts(t *testing.T) {
+
+	store := NewStore(0)
+	store.Add(&Message{From: "a@example.org", To: []string{"x@example.net"}, Data: TestMultipartMessage})
+
+	ts := httptest.NewServer(NewAPIHandler(store))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/api/messages/1/parts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parts []apiPart
+	if err := json.NewDecoder(res.Body).Decode(&parts); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if len(parts) != 3 || parts[0].ContentType != "text/plain" || parts[1].ContentType != "text/html" || !parts[2].Attachment || parts[2].Filename != "report.pdf" {
+		t.Fatalf("unexpected parts %+v", parts)
+	}
+
+	for i, expected := range []string{"café", "<p>cafe</p><script>alert(1)</script>", "%PDF-1.4"} {
+		res, err := http.Get(ts.URL + "/api/messages/1/parts/" + strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if strings.TrimSpace(string(body)) != expected {
+			t.Errorf("part %d: expected %q, got %q", i, expected, body)
+		}
+		if res.Header.Get("Content-Security-Policy") != "sandbox" {
+			t.Errorf("part %d: expected sandbox csp", i)
+		}
+	}
+
+	if res, _ := http.Get(ts.URL + "/api/messages/1/parts/2"); !strings.HasPrefix(res.Header.Get("Content-Disposition"), "attachment") {
+		t.Errorf("expected attachment disposition, got %q", res.Header.Get("Content-Disposition"))
+	}
+
+	res, err = http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") {
+		t.Errorf("unexpected ui response %s %q", res.Status, res.Header.Get("Content-Type"))
+	}
+
+}
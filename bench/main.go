@@ -0,0 +1,423 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Generates smtp load against a server and reports throughput and
+// latency percentiles for each phase of the sessions, optionally with
+// the cpu and memory used by the server process, as text or json.
+//
+//	bench -addr localhost:25 -concurrency 32 -per_conn 10 -size 1k:80,100k:20 -duration 30s -json after.json
+//
+// Two json results can then be compared, exiting 1 when any measure
+// got worse by more than the threshold.
+//
+//	bench -compare before.json after.json
+var (
+	addr        = flag.String("addr", "localhost:25", "host:port of the server under load")
+	concurrency = flag.Int("concurrency", 8, "concurrent connections")
+	per_conn    = flag.Int("per_conn", 1, "messages sent in each session before QUIT")
+	sizes       = flag.String("size", "1k", "message sizes as size[:weight],..., eg 1k:80,1m:20")
+	rate        = flag.Float64("rate", 0, "target messages per second across all connections, 0 for as fast as possible")
+	duration    = flag.Duration("duration", 10*time.Second, "how long to generate load")
+	messages    = flag.Int("messages", 0, "stop after this many messages, 0 to run for -duration")
+	use_tls     = flag.Bool("tls", false, "connect with implicit tls, as to smtps")
+	starttls    = flag.Bool("starttls", false, "upgrade each session with STARTTLS")
+	insecure    = flag.Bool("insecure", false, "skip verifying the server certificate")
+	helo_name   = flag.String("helo", "localhost", "name sent with EHLO")
+	from        = flag.String("from", "bench@example.org", "envelope sender")
+	to          = flag.String("to", "recipient@example.net", "comma separated envelope recipients")
+	timeout     = flag.Duration("timeout", 30*time.Second, "timeout for each connection")
+
+	json_out   = flag.String("json", "", "write the results as json to this file, - for stdout instead of text")
+	server_pid = flag.Int("server_pid", 0, "pid of the server process to report cpu and memory for, linux only")
+	compare_to = flag.Bool("compare", false, "compare the two json results given as arguments instead of generating load")
+	threshold  = flag.Float64("threshold", 10, "percent change flagged as a regression by -compare")
+)
+
+// phases of a session, in order
+const (
+	PhaseConnect  = "connect" // dial and greeting
+	PhaseEhlo     = "ehlo"
+	PhaseStartTLS = "starttls"
+	PhaseMail     = "mail"
+	PhaseRcpt     = "rcpt"
+	PhaseData     = "data" // DATA until the 354
+	PhaseBody     = "body" // the message until the end of data reply
+	PhaseRset     = "rset"
+	PhaseQuit     = "quit"
+)
+
+var (
+	phases = []string{PhaseConnect, PhaseEhlo, PhaseStartTLS, PhaseMail, PhaseRcpt, PhaseData, PhaseBody, PhaseRset, PhaseQuit}
+)
+
+type (
+	generator struct {
+		bodies     []*body
+		total      int
+		recipients []string
+		config     *tls.Config
+		tokens     <-chan time.Time
+		deadline   time.Time
+
+		mu   sync.Mutex
+		sent int
+	}
+	body struct {
+		size   int
+		weight int
+		data   []byte
+	}
+)
+
+func main() {
+	flag.Parse()
+
+	if *compare_to {
+		if flag.NArg() != 2 {
+			log.Fatal("usage: bench -compare before.json after.json")
+		}
+		before, err := readResult(flag.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		after, err := readResult(flag.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if compare(os.Stdout, before, after, *threshold) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	res, err := run()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *json_out != "" {
+		if err := res.writeJSON(*json_out); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *json_out != "-" {
+		res.writeText(os.Stdout)
+	}
+
+}
+
+// run generates the load the flags describe.
+func run() (*result, error) {
+
+	bodies, err := parseSizes(*sizes)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, _ := net.SplitHostPort(*addr)
+
+	g := &generator{
+		bodies:     bodies,
+		recipients: strings.Split(*to, ","),
+		config:     &tls.Config{ServerName: host, InsecureSkipVerify: *insecure},
+		deadline:   time.Now().Add(*duration),
+	}
+	for _, b := range bodies {
+		g.total += b.weight
+	}
+
+	if *rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+		defer ticker.Stop()
+		g.tokens = ticker.C
+	}
+
+	var server *sampler
+	if *server_pid != 0 {
+		if server, err = startSampler(*server_pid); err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		wg        sync.WaitGroup
+		recorders = make([]*recorder, *concurrency)
+		started   = time.Now()
+	)
+
+	for i := range recorders {
+		recorders[i] = newRecorder()
+		wg.Add(1)
+		go func(r *recorder) {
+			defer wg.Done()
+			g.work(r)
+		}(recorders[i])
+	}
+
+	wg.Wait()
+
+	elapsed := time.Since(started)
+
+	total := newRecorder()
+	for _, r := range recorders {
+		total.merge(r)
+	}
+
+	res := total.result(started, elapsed)
+
+	res.Config = make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		res.Config[f.Name] = f.Value.String()
+	})
+
+	if server != nil {
+		if res.Server, err = server.result(); err != nil {
+			log.Print(err)
+		}
+	}
+
+	return res, nil
+
+}
+
+// next reports whether another message should be sent, waiting for
+// its turn when a rate is set.
+func (g *generator) next() bool {
+
+	if g.tokens != nil {
+		<-g.tokens
+	}
+
+	if time.Now().After(g.deadline) {
+		return false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if *messages > 0 && g.sent >= *messages {
+		return false
+	}
+	g.sent++
+
+	return true
+
+}
+
+func (g *generator) work(r *recorder) {
+
+	for g.next() {
+
+		conn, c, err := g.connect(r)
+		if err != nil {
+			// the message it would have carried is counted as failed
+			r.fail(err)
+			continue
+		}
+
+		for i := 0; ; i++ {
+			if i > 0 {
+				if err := r.time(PhaseRset, c.Reset); err != nil {
+					r.fail(err)
+					break
+				}
+			}
+			conn.SetDeadline(time.Now().Add(*timeout))
+			if err := g.send(c, r); err != nil {
+				r.fail(err)
+				break
+			}
+			r.succeed()
+			if i+1 >= *per_conn || !g.next() {
+				break
+			}
+		}
+
+		r.time(PhaseQuit, c.Quit)
+		c.Close()
+
+	}
+
+}
+
+// connect opens a session ready for MAIL, returning the underlying
+// connection for its deadlines.
+func (g *generator) connect(r *recorder) (net.Conn, *smtp.Client, error) {
+
+	var (
+		conn net.Conn
+		c    *smtp.Client
+	)
+
+	err := r.time(PhaseConnect, func() error {
+		var err error
+		dialer := &net.Dialer{Timeout: *timeout}
+		if *use_tls {
+			conn, err = tls.DialWithDialer(dialer, "tcp", *addr, g.config)
+		} else {
+			conn, err = dialer.Dial("tcp", *addr)
+		}
+		if err != nil {
+			return err
+		}
+		conn.SetDeadline(time.Now().Add(*timeout))
+		c, err = smtp.NewClient(conn, g.config.ServerName)
+		if err != nil {
+			conn.Close()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := r.time(PhaseEhlo, func() error { return c.Hello(*helo_name) }); err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+
+	if *starttls {
+		if err := r.time(PhaseStartTLS, func() error { return c.StartTLS(g.config) }); err != nil {
+			c.Close()
+			return nil, nil, err
+		}
+	}
+
+	return conn, c, nil
+
+}
+
+func (g *generator) send(c *smtp.Client, r *recorder) error {
+
+	b := g.body()
+
+	if err := r.time(PhaseMail, func() error { return c.Mail(*from) }); err != nil {
+		return err
+	}
+
+	for _, rcpt := range g.recipients {
+		if err := r.time(PhaseRcpt, func() error { return c.Rcpt(rcpt) }); err != nil {
+			return err
+		}
+	}
+
+	var w io.WriteCloser
+	if err := r.time(PhaseData, func() (err error) { w, err = c.Data(); return }); err != nil {
+		return err
+	}
+
+	err := r.time(PhaseBody, func() error {
+		if _, err := w.Write(b.data); err != nil {
+			return err
+		}
+		return w.Close()
+	})
+	if err == nil {
+		r.bytes += int64(len(b.data))
+	}
+
+	return err
+
+}
+
+// body picks a message by the size weights.
+func (g *generator) body() *body {
+	n := rand.Intn(g.total)
+	for _, b := range g.bodies {
+		if n < b.weight {
+			return b
+		}
+		n -= b.weight
+	}
+	return g.bodies[len(g.bodies)-1]
+}
+
+// parseSizes parses a distribution like 1k:80,1m:20 and builds a
+// message of each size.
+func parseSizes(s string) ([]*body, error) {
+
+	var bodies []*body
+
+	for _, field := range strings.Split(s, ",") {
+
+		size, weight, ok := strings.Cut(strings.TrimSpace(field), ":")
+		if !ok {
+			weight = "1"
+		}
+
+		b := &body{}
+
+		n, err := parseSize(size)
+		if err != nil {
+			return nil, fmt.Errorf("-size %q: %s", field, err)
+		}
+		b.size = n
+
+		if b.weight, err = strconv.Atoi(weight); err != nil || b.weight <= 0 {
+			return nil, fmt.Errorf("-size %q: bad weight", field)
+		}
+
+		b.data = newMessage(b.size)
+		bodies = append(bodies, b)
+
+	}
+
+	return bodies, nil
+
+}
+
+func parseSize(s string) (int, error) {
+
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(strings.ToLower(s), "k"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(strings.ToLower(s), "m"):
+		multiplier = 1 << 20
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+
+	return n * multiplier, nil
+
+}
+
+// newMessage returns a message of about size bytes with lines of a
+// sensible length.
+func newMessage(size int) []byte {
+
+	message := []byte(fmt.Sprintf("From: <%s>\r\nTo: <%s>\r\nSubject: helo bench %d bytes\r\n\r\n", *from, *to, size))
+
+	line := strings.Repeat("x", 76) + "\r\n"
+	for len(message) < size {
+		if rest := size - len(message); rest < len(line) {
+			message = append(message, strings.Repeat("x", rest)...)
+			break
+		}
+		message = append(message, line...)
+	}
+
+	return message
+
+}
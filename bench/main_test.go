@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/jasonmoo/helo/helotest"
+)
+
+func TestParseSize(t *testing.T) {
+
+	for s, expected := range map[string]int{
+		"0":    0,
+		"512":  512,
+		"1k":   1 << 10,
+		"1K":   1 << 10,
+		"10k":  10 << 10,
+		"1m":   1 << 20,
+		"2M":   2 << 20,
+		"":     -1,
+		"k":    -1,
+		"-1k":  -1,
+		"1g":   -1,
+		"1.5k": -1,
+		"1kk":  -1,
+	} {
+		n, err := parseSize(s)
+		if expected < 0 {
+			if err == nil {
+				t.Errorf("parseSize(%q) = %d, expected an error", s, n)
+			}
+			continue
+		}
+		if err != nil || n != expected {
+			t.Errorf("parseSize(%q) = %d, %v, expected %d", s, n, err, expected)
+		}
+	}
+
+}
+
+func TestParseSizes(t *testing.T) {
+
+	bodies, err := parseSizes("1k:80, 100:20,2k")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct{ size, weight int }{{1 << 10, 80}, {100, 20}, {2 << 10, 1}}
+	if len(bodies) != len(expected) {
+		t.Fatalf("expected %d bodies, got %d", len(expected), len(bodies))
+	}
+	for i, b := range bodies {
+		if b.size != expected[i].size || b.weight != expected[i].weight || len(b.data) != b.size {
+			t.Errorf("body %d: size %d, weight %d, %d bytes, expected %+v", i, b.size, b.weight, len(b.data), expected[i])
+		}
+	}
+
+	// messages smaller than their headers are just the headers
+	if bodies, err := parseSizes("0"); err != nil || !strings.HasSuffix(string(bodies[0].data), "\r\n\r\n") {
+		t.Errorf("unexpected empty message %v", err)
+	}
+
+	for _, s := range []string{"", "1k:", "1k:0", "1k:-1", "1k:x", "x:1", "1k,,2k"} {
+		if _, err := parseSizes(s); err == nil {
+			t.Errorf("parseSizes(%q) expected an error", s)
+		}
+	}
+
+}
+
+func TestRun(t *testing.T) {
+
+	s := helotest.NewServer(t)
+
+	for name, value := range map[string]string{
+		"addr":        s.Addr,
+		"concurrency": "2",
+		"per_conn":    "2",
+		"size":        "1k:1,2k:1",
+		"messages":    "5",
+		"duration":    "5s",
+		"timeout":     "5s",
+	} {
+		if err := flag.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Sent != 5 || res.Failed != 0 || len(s.Messages()) != 5 {
+		t.Errorf("expected 5 messages sent, got %d sent, %d failed, %d captured", res.Sent, res.Failed, len(s.Messages()))
+	}
+	for _, phase := range []string{PhaseConnect, PhaseEhlo, PhaseMail, PhaseRcpt, PhaseData, PhaseBody, PhaseQuit} {
+		if p, ok := res.Phases[phase]; !ok || p.Count == 0 {
+			t.Errorf("expected %s latencies, got %+v", phase, p)
+		}
+	}
+	if res.Config["messages"] != "5" || res.Duration <= 0 || res.Duration > 5 {
+		t.Errorf("unexpected result %+v", res)
+	}
+
+}
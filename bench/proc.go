@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// processResult is the cpu and memory used by the server process
+	// over the run, read from /proc so only on linux.
+	processResult struct {
+		PID        int     `json:"pid"`
+		CPUSeconds float64 `json:"cpu_seconds"`
+		CPUPercent float64 `json:"cpu_percent"`
+		RSS        int64   `json:"rss_bytes"`
+		MaxRSS     int64   `json:"max_rss_bytes"`
+	}
+	// sampler polls a process for its peak rss while the load runs.
+	sampler struct {
+		pid     int
+		cpu     float64
+		started time.Time
+		maxRSS  int64
+		stop    chan struct{}
+		wg      sync.WaitGroup
+	}
+)
+
+const (
+	// USER_HZ, which is 100 on every linux platform go supports
+	clock_ticks = 100
+
+	sample_interval = 100 * time.Millisecond
+)
+
+func startSampler(pid int) (*sampler, error) {
+
+	cpu, err := processCPU(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &sampler{
+		pid:     pid,
+		cpu:     cpu,
+		started: time.Now(),
+		stop:    make(chan struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.run()
+
+	return s, nil
+
+}
+
+func (s *sampler) run() {
+
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(sample_interval)
+	defer ticker.Stop()
+
+	for {
+		if rss, err := processRSS(s.pid); err == nil && rss > s.maxRSS {
+			s.maxRSS = rss
+		}
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+
+}
+
+func (s *sampler) result() (*processResult, error) {
+
+	close(s.stop)
+	s.wg.Wait()
+
+	cpu, err := processCPU(s.pid)
+	if err != nil {
+		return nil, err
+	}
+	rss, err := processRSS(s.pid)
+	if err != nil {
+		return nil, err
+	}
+	if rss > s.maxRSS {
+		s.maxRSS = rss
+	}
+
+	used := cpu - s.cpu
+
+	return &processResult{
+		PID:        s.pid,
+		CPUSeconds: used,
+		CPUPercent: used / time.Since(s.started).Seconds() * 100,
+		RSS:        rss,
+		MaxRSS:     s.maxRSS,
+	}, nil
+
+}
+
+// processCPU returns the user and system cpu seconds used by pid.
+func processCPU(pid int) (float64, error) {
+
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+
+	// fields after the parenthesized command, which may contain spaces,
+	// starting from the third: utime and stime are the 14th and 15th
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("/proc/%d/stat: too few fields", pid)
+	}
+
+	utime, err := strconv.ParseFloat(fields[11], 64)
+	if err != nil {
+		return 0, err
+	}
+	stime, err := strconv.ParseFloat(fields[12], 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return (utime + stime) / clock_ticks, nil
+
+}
+
+// processRSS returns the resident set size of pid in bytes.
+func processRSS(pid int) (int64, error) {
+
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "VmRSS:"); ok {
+			kb, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+			return kb << 10, err
+		}
+	}
+
+	return 0, fmt.Errorf("/proc/%d/status: no VmRSS", pid)
+
+}
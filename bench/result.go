@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+type (
+	// result is what a run writes with -json and what -compare reads
+	// back.  Latencies are in milliseconds.
+	result struct {
+		Started    time.Time               `json:"started"`
+		Duration   float64                 `json:"duration_seconds"`
+		Config     map[string]string       `json:"config"`
+		Sent       int                     `json:"sent"`
+		Failed     int                     `json:"failed"`
+		Bytes      int64                   `json:"bytes"`
+		Throughput float64                 `json:"messages_per_second"`
+		Errors     map[string]int          `json:"errors"`
+		Phases     map[string]*phaseResult `json:"phases"`
+		Server     *processResult          `json:"server,omitempty"`
+	}
+	phaseResult struct {
+		Count int     `json:"count"`
+		Mean  float64 `json:"mean_ms"`
+		P50   float64 `json:"p50_ms"`
+		P90   float64 `json:"p90_ms"`
+		P99   float64 `json:"p99_ms"`
+		Max   float64 `json:"max_ms"`
+	}
+)
+
+var (
+	// flags that do not change the load
+	result_flags = map[string]bool{"json": true, "server_pid": true, "compare": true, "threshold": true}
+)
+
+func (res *result) writeText(w io.Writer) {
+
+	fmt.Fprintf(w, "duration    %.3fs\n", res.Duration)
+	fmt.Fprintf(w, "messages    %d sent, %d failed\n", res.Sent, res.Failed)
+	fmt.Fprintf(w, "throughput  %.1f messages/s, %.2f MB/s\n", res.Throughput, float64(res.Bytes)/res.Duration/(1<<20))
+
+	if len(res.Errors) > 0 {
+		classes := make([]string, 0, len(res.Errors))
+		for class := range res.Errors {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		fmt.Fprintf(w, "errors     ")
+		for _, class := range classes {
+			fmt.Fprintf(w, " %s: %d", class, res.Errors[class])
+		}
+		fmt.Fprintln(w)
+	}
+
+	if s := res.Server; s != nil {
+		fmt.Fprintf(w, "server      pid %d, %.2fs cpu (%.0f%%), rss %.1f MB, max rss %.1f MB\n", s.PID, s.CPUSeconds, s.CPUPercent, float64(s.RSS)/(1<<20), float64(s.MaxRSS)/(1<<20))
+	}
+
+	fmt.Fprintf(w, "\n%-10s %8s %10s %10s %10s %10s %10s\n", "phase", "count", "mean ms", "p50 ms", "p90 ms", "p99 ms", "max ms")
+	for _, phase := range phases {
+		if p, ok := res.Phases[phase]; ok {
+			fmt.Fprintf(w, "%-10s %8d %10.3f %10.3f %10.3f %10.3f %10.3f\n", phase, p.Count, p.Mean, p.P50, p.P90, p.P99, p.Max)
+		}
+	}
+
+}
+
+func (res *result) writeJSON(name string) error {
+
+	data, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if name == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(name, data, 0644)
+
+}
+
+func readResult(name string) (*result, error) {
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &result{}
+	if err := json.Unmarshal(data, res); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+
+	return res, nil
+
+}
+
+// compare writes the change of each measure from before to after, flagging
+// those worse by more than threshold percent, and reports whether any
+// were.
+func compare(w io.Writer, before, after *result, threshold float64) bool {
+
+	regressed := false
+
+	// higher is worse unless lowerWorse
+	line := func(name string, a, b float64, lowerWorse bool) {
+		change := 0.0
+		switch {
+		case a != 0:
+			change = (b - a) / a * 100
+		case b > 0:
+			change = math.Inf(1)
+		}
+		flag := ""
+		if (lowerWorse && change < -threshold) || (!lowerWorse && change > threshold) {
+			flag = "  REGRESSION"
+			regressed = true
+		}
+		fmt.Fprintf(w, "%-22s %12.3f %12.3f %+9.1f%%%s\n", name, a, b, change, flag)
+	}
+
+	// results of different loads are not comparable
+	names := make([]string, 0, len(after.Config))
+	for name := range after.Config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !result_flags[name] && before.Config[name] != after.Config[name] {
+			fmt.Fprintf(w, "warning: -%s was %q, now %q\n", name, before.Config[name], after.Config[name])
+		}
+	}
+
+	fmt.Fprintf(w, "%-22s %12s %12s %10s\n", "", "before", "after", "change")
+
+	line("messages/s", before.Throughput, after.Throughput, true)
+	line("failed %", failedPercent(before), failedPercent(after), false)
+
+	for _, phase := range phases {
+		a, ok := before.Phases[phase]
+		if !ok {
+			continue
+		}
+		b, ok := after.Phases[phase]
+		if !ok {
+			continue
+		}
+		line(phase+" p50 ms", a.P50, b.P50, false)
+		line(phase+" p90 ms", a.P90, b.P90, false)
+		line(phase+" p99 ms", a.P99, b.P99, false)
+	}
+
+	if before.Server != nil && after.Server != nil && before.Sent > 0 && after.Sent > 0 {
+		line("server cpu ms/message", before.Server.CPUSeconds*1000/float64(before.Sent), after.Server.CPUSeconds*1000/float64(after.Sent), false)
+		line("server max rss MB", float64(before.Server.MaxRSS)/(1<<20), float64(after.Server.MaxRSS)/(1<<20), false)
+	}
+
+	classes := make(map[string]bool)
+	for class := range before.Errors {
+		classes[class] = true
+	}
+	for class := range after.Errors {
+		classes[class] = true
+	}
+	sorted := make([]string, 0, len(classes))
+	for class := range classes {
+		sorted = append(sorted, class)
+	}
+	sort.Strings(sorted)
+	for _, class := range sorted {
+		fmt.Fprintf(w, "%-22s %12d %12d\n", "errors "+class, before.Errors[class], after.Errors[class])
+	}
+
+	return regressed
+
+}
+
+func failedPercent(res *result) float64 {
+	if res.Sent+res.Failed == 0 {
+		return 0
+	}
+	return float64(res.Failed) / float64(res.Sent+res.Failed) * 100
+}
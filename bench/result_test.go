@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+
+	for _, test := range []struct {
+		name      string
+		before    *result
+		after     *result
+		line      string // of the output, by its measure
+		flagged   bool
+		regressed bool
+	}{
+		{
+			name:      "throughput up",
+			before:    &result{Throughput: 100},
+			after:     &result{Throughput: 120},
+			line:      "messages/s",
+			flagged:   false,
+			regressed: false,
+		},
+		{
+			// lower is worse for throughput
+			name:      "throughput down",
+			before:    &result{Throughput: 100},
+			after:     &result{Throughput: 80},
+			line:      "messages/s",
+			flagged:   true,
+			regressed: true,
+		},
+		{
+			name:      "throughput down within threshold",
+			before:    &result{Throughput: 100},
+			after:     &result{Throughput: 95},
+			line:      "messages/s",
+			flagged:   false,
+			regressed: false,
+		},
+		{
+			// higher is worse for latencies
+			name:      "latency up",
+			before:    &result{Phases: map[string]*phaseResult{PhaseMail: {P50: 1, P90: 1, P99: 1}}},
+			after:     &result{Phases: map[string]*phaseResult{PhaseMail: {P50: 2, P90: 1, P99: 1}}},
+			line:      "mail p50 ms",
+			flagged:   true,
+			regressed: true,
+		},
+		{
+			name:      "latency down",
+			before:    &result{Phases: map[string]*phaseResult{PhaseMail: {P50: 2, P90: 1, P99: 1}}},
+			after:     &result{Phases: map[string]*phaseResult{PhaseMail: {P50: 1, P90: 1, P99: 1}}},
+			line:      "mail p50 ms",
+			flagged:   false,
+			regressed: false,
+		},
+		{
+			// from nothing is an infinite change
+			name:      "failures from zero",
+			before:    &result{Sent: 10},
+			after:     &result{Sent: 9, Failed: 1},
+			line:      "failed %",
+			flagged:   true,
+			regressed: true,
+		},
+		{
+			name:      "zero to zero",
+			before:    &result{Sent: 10},
+			after:     &result{Sent: 10},
+			line:      "failed %",
+			flagged:   false,
+			regressed: false,
+		},
+	} {
+
+		var buf bytes.Buffer
+		regressed := compare(&buf, test.before, test.after, 10)
+
+		if regressed != test.regressed {
+			t.Errorf("%s: regressed %t, expected %t\n%s", test.name, regressed, test.regressed, buf.String())
+		}
+
+		line := outputLine(buf.String(), test.line)
+		if line == "" {
+			t.Errorf("%s: no %q line in\n%s", test.name, test.line, buf.String())
+			continue
+		}
+		if flagged := strings.HasSuffix(line, "REGRESSION"); flagged != test.flagged {
+			t.Errorf("%s: flagged %t, expected %t: %q", test.name, flagged, test.flagged, line)
+		}
+
+	}
+
+}
+
+func TestCompareZeroBaseline(t *testing.T) {
+
+	var buf bytes.Buffer
+	compare(&buf, &result{Sent: 10}, &result{Sent: 9, Failed: 1}, 10)
+
+	if line := outputLine(buf.String(), "failed %"); !strings.Contains(line, "+Inf%") {
+		t.Errorf("expected an infinite change, got %q", line)
+	}
+
+}
+
+func TestCompareConfig(t *testing.T) {
+
+	before := &result{Config: map[string]string{"concurrency": "8", "size": "1k", "json": "before.json", "threshold": "10"}}
+	after := &result{Config: map[string]string{"concurrency": "16", "size": "1k", "json": "after.json", "threshold": "5"}}
+
+	var buf bytes.Buffer
+	compare(&buf, before, after, 10)
+
+	var warnings []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, "warning:") {
+			warnings = append(warnings, line)
+		}
+	}
+
+	// only flags changing the load are warned about
+	if len(warnings) != 1 || warnings[0] != `warning: -concurrency was "8", now "16"` {
+		t.Errorf("unexpected warnings %q", warnings)
+	}
+
+}
+
+// outputLine returns the line of compare's output for measure.
+func outputLine(output, measure string) string {
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, measure+"  ") {
+			return line
+		}
+	}
+	return ""
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type (
+	// recorder collects the results of one worker, so needs no
+	// locking, and is merged with the others at the end.
+	recorder struct {
+		latencies map[string][]time.Duration
+		errors    map[string]int
+		sent      int
+		failed    int
+		bytes     int64
+	}
+)
+
+func newRecorder() *recorder {
+	return &recorder{
+		latencies: make(map[string][]time.Duration),
+		errors:    make(map[string]int),
+	}
+}
+
+// time runs f as phase, recording its latency when it succeeds.
+func (r *recorder) time(phase string, f func() error) error {
+	start := time.Now()
+	err := f()
+	if err == nil {
+		r.latencies[phase] = append(r.latencies[phase], time.Since(start))
+	}
+	return err
+}
+
+func (r *recorder) succeed() {
+	r.sent++
+}
+
+func (r *recorder) fail(err error) {
+	r.failed++
+	r.errors[errorClass(err)]++
+}
+
+func (r *recorder) merge(o *recorder) {
+	for phase, latencies := range o.latencies {
+		r.latencies[phase] = append(r.latencies[phase], latencies...)
+	}
+	for class, n := range o.errors {
+		r.errors[class] += n
+	}
+	r.sent += o.sent
+	r.failed += o.failed
+	r.bytes += o.bytes
+}
+
+func (r *recorder) result(started time.Time, elapsed time.Duration) *result {
+
+	seconds := elapsed.Seconds()
+
+	res := &result{
+		Started:    started,
+		Duration:   seconds,
+		Sent:       r.sent,
+		Failed:     r.failed,
+		Bytes:      r.bytes,
+		Throughput: float64(r.sent) / seconds,
+		Errors:     r.errors,
+		Phases:     make(map[string]*phaseResult),
+	}
+
+	for phase, latencies := range r.latencies {
+
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+		var sum time.Duration
+		for _, l := range latencies {
+			sum += l
+		}
+
+		res.Phases[phase] = &phaseResult{
+			Count: len(latencies),
+			Mean:  ms(sum / time.Duration(len(latencies))),
+			P50:   ms(percentile(latencies, 50)),
+			P90:   ms(percentile(latencies, 90)),
+			P99:   ms(percentile(latencies, 99)),
+			Max:   ms(latencies[len(latencies)-1]),
+		}
+
+	}
+
+	return res
+
+}
+
+// percentile returns the nearest rank percentile p of sorted, the
+// smallest value at least p percent of them are less or equal to.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p*float64(len(sorted))/100)) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// errorClass is the reply code of a failure, or what went wrong when
+// there was none.
+func errorClass(err error) string {
+
+	var te *textproto.Error
+	if errors.As(err, &te) {
+		return strconv.Itoa(te.Code)
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return "timeout"
+	}
+
+	return "network"
+
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+
+	ten := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+
+	for _, test := range []struct {
+		sorted   []time.Duration
+		p        float64
+		expected time.Duration
+	}{
+		{ten, 0, 1},
+		{ten, 10, 1},
+		{ten, 11, 2},
+		{ten, 50, 5},
+		{ten, 51, 6},
+		{ten, 90, 9},
+		{ten, 91, 10},
+		{ten, 99, 10},
+		{ten, 100, 10},
+		{[]time.Duration{7}, 0, 7},
+		{[]time.Duration{7}, 50, 7},
+		{[]time.Duration{7}, 100, 7},
+		{[]time.Duration{1, 2}, 50, 1},
+		{[]time.Duration{1, 2}, 51, 2},
+		{[]time.Duration{1, 2, 3}, 99, 3},
+	} {
+		if got := percentile(test.sorted, test.p); got != test.expected {
+			t.Errorf("percentile(%v, %v) = %v, expected %v", test.sorted, test.p, got, test.expected)
+		}
+	}
+
+	// the percents are not exact in binary
+	hundred := make([]time.Duration, 100)
+	for i := range hundred {
+		hundred[i] = time.Duration(i + 1)
+	}
+	for p := 1; p <= 100; p++ {
+		if got := percentile(hundred, float64(p)); got != time.Duration(p) {
+			t.Errorf("percentile of 1 to 100 at %d = %v", p, got)
+		}
+	}
+
+}
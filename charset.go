@@ -0,0 +1,92 @@
+package helo
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+type (
+	// CharsetError is the name of a charset ToUTF8 cannot decode.
+	CharsetError string
+)
+
+var (
+	// windows-1252 differs from latin-1 only in 0x80-0x9f
+	windows_1252 = [32]rune{
+		'€', utf8.RuneError, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', utf8.RuneError, 'Ž', utf8.RuneError,
+		utf8.RuneError, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', utf8.RuneError, 'ž', 'Ÿ',
+	}
+	// iso-8859-15 differs from latin-1 in eight places
+	iso_8859_15 = map[byte]rune{
+		0xa4: '€', 0xa6: 'Š', 0xa8: 'š', 0xb4: 'Ž', 0xb8: 'ž', 0xbc: 'Œ', 0xbd: 'œ', 0xbe: 'Ÿ',
+	}
+)
+
+func (e CharsetError) Error() string {
+	return fmt.Sprintf("unsupported charset %q, only utf-8, us-ascii, iso-8859-1, iso-8859-15 and windows-1252 are decoded", string(e))
+}
+
+// ToUTF8 converts text in the named charset to utf-8.  Only utf-8,
+// us-ascii and the common western single byte charsets are supported,
+// anything else returns a CharsetError along with the text unchanged.
+// Decoding others, e.g. iso-2022-jp, shift_jis, gb2312 or koi8-r, would
+// take golang.org/x/text, which this package does not depend on.
+func ToUTF8(charset string, text []byte) ([]byte, error) {
+
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return text, nil
+
+	case "iso-8859-1", "iso8859-1", "latin1", "latin-1", "l1":
+		return decodeSingleByte(text, func(b byte) rune { return rune(b) }), nil
+
+	case "windows-1252", "cp1252":
+		return decodeSingleByte(text, func(b byte) rune {
+			if b >= 0x80 && b < 0xa0 {
+				return windows_1252[b-0x80]
+			}
+			return rune(b)
+		}), nil
+
+	case "iso-8859-15", "iso8859-15", "latin9", "latin-9":
+		return decodeSingleByte(text, func(b byte) rune {
+			if r, ok := iso_8859_15[b]; ok {
+				return r
+			}
+			return rune(b)
+		}), nil
+	}
+
+	return text, CharsetError(charset)
+
+}
+
+func decodeSingleByte(text []byte, decode func(byte) rune) []byte {
+	var buf bytes.Buffer
+	buf.Grow(len(text))
+	for _, b := range text {
+		if b < utf8.RuneSelf {
+			buf.WriteByte(b)
+		} else {
+			buf.WriteRune(decode(b))
+		}
+	}
+	return buf.Bytes()
+}
+
+// charsetReader lets mime.WordDecoder decode words in any charset
+// ToUTF8 supports.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	text, err := io.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	text, err = ToUTF8(charset, text)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(text), nil
+}
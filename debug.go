@@ -0,0 +1,205 @@
+package helo
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DEBUG ENDPOINT
+//
+// GET    /debug/sessions       sessions in progress, oldest first
+// DELETE /debug/sessions/{id}  close a session
+// GET    /debug/vars           expvar
+
+type (
+	// Registry tracks the sessions in progress on the servers it is
+	// set on, for listing and killing them over http.
+	Registry struct {
+		mu       sync.Mutex
+		sessions map[string]*session
+	}
+	// SessionInfo is a snapshot of a session in progress.
+	SessionInfo struct {
+		ID         string        `json:"id"`
+		RemoteAddr string        `json:"remote_addr"`
+		State      string        `json:"state"`
+		Command    string        `json:"command"` // the last read
+		BytesIn    int64         `json:"bytes_in"`
+		BytesOut   int64         `json:"bytes_out"`
+		Started    time.Time     `json:"started"`
+		Age        time.Duration `json:"age"`
+	}
+)
+
+const (
+	// session states
+	StateConnected = "connected" // before HELO, EHLO or LHLO
+	StateGreeted   = "greeted"
+	StateMail      = "mail" // sender given
+	StateRcpt      = "rcpt" // recipients given
+	StateData      = "data" // reading message data
+	StateTLS       = "tls"  // in a tls handshake
+	StateAuth      = "auth"
+	StateScript    = "script"
+)
+
+var (
+	SessionNotFoundError = errors.New("session not found")
+)
+
+func NewRegistry() *Registry {
+	return &Registry{sessions: make(map[string]*session)}
+}
+
+// SetRegistry registers every session into registry while it lasts.
+func (s *SmtpServer) SetRegistry(registry *Registry) {
+	s.registry = registry
+}
+
+func (reg *Registry) add(c *session) {
+	if reg == nil {
+		return
+	}
+	reg.mu.Lock()
+	reg.sessions[c.id] = c
+	reg.mu.Unlock()
+}
+
+func (reg *Registry) remove(c *session) {
+	if reg == nil {
+		return
+	}
+	reg.mu.Lock()
+	delete(reg.sessions, c.id)
+	reg.mu.Unlock()
+}
+
+// Sessions returns the sessions in progress, oldest first.
+func (reg *Registry) Sessions() []SessionInfo {
+
+	reg.mu.Lock()
+	sessions := make([]SessionInfo, 0, len(reg.sessions))
+	for _, c := range reg.sessions {
+		sessions = append(sessions, c.info())
+	}
+	reg.mu.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Started.Before(sessions[j].Started) })
+
+	return sessions
+
+}
+
+// Kill closes the connection of the session with id, which then ends
+// with OutcomeKilled.
+func (reg *Registry) Kill(id string) error {
+
+	reg.mu.Lock()
+	c, ok := reg.sessions[id]
+	reg.mu.Unlock()
+
+	if !ok {
+		return SessionNotFoundError
+	}
+
+	c.mu.Lock()
+	c.killed = true
+	c.mu.Unlock()
+
+	return c.conn.Close()
+
+}
+
+func (reg *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	path := strings.Trim(r.URL.Path, "/")
+
+	switch {
+	case path == "debug/sessions":
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, reg.Sessions())
+
+	case strings.HasPrefix(path, "debug/sessions/"):
+		if r.Method != "DELETE" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		switch err := reg.Kill(strings.TrimPrefix(path, "debug/sessions/")); err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case SessionNotFoundError:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	case path == "debug/vars":
+		expvar.Handler().ServeHTTP(w, r)
+
+	default:
+		http.NotFound(w, r)
+	}
+
+}
+
+func (c *session) info() SessionInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return SessionInfo{
+		ID:         c.id,
+		RemoteAddr: c.stats.RemoteAddr,
+		State:      c.state,
+		Command:    c.verb,
+		BytesIn:    c.stats.BytesIn,
+		BytesOut:   c.stats.BytesOut,
+		Started:    c.stats.Started,
+		Age:        time.Since(c.stats.Started),
+	}
+}
+
+// The session goroutine changes what info reads under the lock.
+
+func (c *session) setState(state string) {
+	c.mu.Lock()
+	c.state = state
+	c.mu.Unlock()
+}
+
+func (c *session) setVerb(verb string) {
+	c.mu.Lock()
+	c.verb = verb
+	c.mu.Unlock()
+}
+
+func (c *session) read(n int) {
+	c.mu.Lock()
+	c.stats.BytesIn += int64(n)
+	c.mu.Unlock()
+}
+
+func (c *session) wasKilled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.killed
+}
+
+// transactionState is the state between commands.
+func transactionState(helo string, m *Message) string {
+	switch {
+	case len(m.To) > 0:
+		return StateRcpt
+	case m.MailArg != "":
+		return StateMail
+	case helo != "":
+		return StateGreeted
+	}
+	return StateConnected
+}
@@ -0,0 +1,99 @@
+package helo
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const (
+	DebugTestHost = "127.0.0.1:9989"
+)
+
+func TestRegistry(t *testing.T) {
+
+	registry := NewRegistry()
+
+	s := NewSmtpServer(DebugTestHost)
+	s.SetRegistry(registry)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", DebugTestHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	r := bufio.NewReader(conn)
+	for _, command := range []string{"", "HELO localhost\r\n", "MAIL FROM:<sender@example.org>\r\n"} {
+		conn.Write([]byte(command))
+		if _, err := r.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		registry.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	// the state changes once the session loops back to read
+	var sessions []SessionInfo
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		rec := serve("GET", "/debug/sessions")
+		if err := json.Unmarshal(rec.Body.Bytes(), &sessions); err != nil {
+			t.Fatal(err)
+		}
+		if len(sessions) == 1 && sessions[0].State == StateMail {
+			break
+		}
+	}
+
+	if len(sessions) != 1 {
+		t.Fatalf("expected 1 session, got %d", len(sessions))
+	}
+	info := sessions[0]
+	if info.State != StateMail || info.Command != CommandMail || info.RemoteAddr != conn.LocalAddr().String() {
+		t.Errorf("unexpected session %+v", info)
+	}
+	if info.BytesIn != int64(len("HELO localhost\r\nMAIL FROM:<sender@example.org>\r\n")) || info.BytesOut == 0 || info.Age <= 0 {
+		t.Errorf("unexpected session %+v", info)
+	}
+
+	if rec := serve("DELETE", "/debug/sessions/nosuchsession"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	if rec := serve("DELETE", "/debug/sessions/"+info.ID); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected %d, got %d", http.StatusNoContent, rec.Code)
+	}
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Error("expected the killed session to be closed")
+	}
+
+	var stats ServerStats
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if stats = s.Stats(); stats.Sessions == 1 {
+			break
+		}
+	}
+	if stats.Outcomes[OutcomeKilled] != 1 {
+		t.Errorf("expected a killed outcome, got %v", stats.Outcomes)
+	}
+	if sessions := registry.Sessions(); len(sessions) != 0 {
+		t.Errorf("expected no sessions, got %d", len(sessions))
+	}
+
+	if rec := serve("GET", "/debug/vars"); rec.Code != http.StatusOK {
+		t.Errorf("expected %d, got %d", http.StatusOK, rec.Code)
+	}
+
+}
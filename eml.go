@@ -0,0 +1,113 @@
+package helo
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type (
+	// EmlBackend writes each message to its own .eml file next to a
+	// .json sidecar holding the envelope.  Without Rotation files are
+	// written directly into dir, with it into timestamped
+	// subdirectories of dir that are started whenever Rotation is due.
+	EmlBackend struct {
+		Rotation Rotation
+
+		dir  string
+		host string
+
+		mu      sync.Mutex
+		current string
+		started time.Time
+		size    int64
+		count   uint64
+	}
+)
+
+func NewEmlBackend(dir string) (*EmlBackend, error) {
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	return &EmlBackend{
+		dir:  dir,
+		host: host,
+	}, nil
+
+}
+
+func (b *EmlBackend) Deliver(m *Message) error {
+
+	data := []byte(m.Stamped(b.host))
+
+	envelope, err := json.MarshalIndent(m.Envelope(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	dir, err := b.directory()
+	if err != nil {
+		return err
+	}
+
+	b.count++
+	name := filepath.Join(dir, fmt.Sprintf("%s-%d", m.Received.UTC().Format(rotation_suffix_format), b.count))
+
+	if err := writeFileAtomic(name+".eml", data); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(name+".json", append(envelope, '\n')); err != nil {
+		return err
+	}
+
+	b.size += int64(len(data) + len(envelope) + 1)
+
+	return nil
+
+}
+
+func (b *EmlBackend) directory() (string, error) {
+
+	if !b.Rotation.enabled() {
+		return b.dir, nil
+	}
+
+	if len(b.current) > 0 && !b.Rotation.due(b.size, b.started) {
+		return b.current, nil
+	}
+
+	b.started = time.Now()
+	b.size = 0
+	b.current = filepath.Join(b.dir, b.started.Format(rotation_suffix_format))
+
+	return b.current, os.MkdirAll(b.current, 0700)
+
+}
+
+// writeFileAtomic writes to a temporary name first so that readers
+// of the directory never see a partial file.
+func writeFileAtomic(name string, data []byte) error {
+
+	tmp := name + ".tmp"
+
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, name)
+
+}
@@ -0,0 +1,135 @@
+package helo
+
+import (
+	"sync"
+	"time"
+)
+
+type (
+	// Greylist simulates greylisting in the RCPT path.  The first
+	// attempt of a (client ip, sender, recipient) triplet is deferred
+	// with a 451 and retries are accepted once Delay has elapsed.
+	//
+	// Triplets not passed within RetryWindow of their first attempt,
+	// and passed ones not seen for PassedTTL, are forgotten, so start
+	// over.  Zero keeps them until removed.
+	Greylist struct {
+		Delay       time.Duration
+		RetryWindow time.Duration
+		PassedTTL   time.Duration
+
+		mu       sync.Mutex
+		triplets map[Triplet]*TripletState
+		swept    time.Time
+	}
+	Triplet struct {
+		IP   string
+		From string
+		To   string
+	}
+	TripletState struct {
+		FirstSeen time.Time
+		LastSeen  time.Time
+		Attempts  int
+		Passed    bool
+	}
+)
+
+const (
+	DefaultGreylistDelay       = 5 * time.Minute
+	DefaultGreylistRetryWindow = 2 * 24 * time.Hour
+	DefaultGreylistPassedTTL   = 35 * 24 * time.Hour
+
+	// how often Check sweeps out expired triplets
+	greylist_sweep_interval = time.Minute
+)
+
+func NewGreylist(delay time.Duration) *Greylist {
+	return &Greylist{
+		Delay:       delay,
+		RetryWindow: DefaultGreylistRetryWindow,
+		PassedTTL:   DefaultGreylistPassedTTL,
+		triplets:    make(map[Triplet]*TripletState),
+		swept:       time.Now(),
+	}
+}
+
+// Check records an attempt for the triplet and reports whether
+// it should be accepted.
+func (g *Greylist) Check(t Triplet) bool {
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(g.swept) >= greylist_sweep_interval {
+		g.sweep(now)
+	}
+
+	state, exists := g.triplets[t]
+	if !exists || g.expired(state, now) {
+		g.triplets[t] = &TripletState{
+			FirstSeen: now,
+			LastSeen:  now,
+			Attempts:  1,
+		}
+		return false
+	}
+
+	state.LastSeen = now
+	state.Attempts++
+
+	if !state.Passed && now.Sub(state.FirstSeen) >= g.Delay {
+		state.Passed = true
+	}
+
+	return state.Passed
+
+}
+
+// Triplets returns a snapshot of the current triplet state.
+func (g *Greylist) Triplets() map[Triplet]TripletState {
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.sweep(time.Now())
+
+	triplets := make(map[Triplet]TripletState, len(g.triplets))
+	for t, state := range g.triplets {
+		triplets[t] = *state
+	}
+
+	return triplets
+
+}
+
+// sweep forgets expired triplets, with mu held.
+func (g *Greylist) sweep(now time.Time) {
+	for t, state := range g.triplets {
+		if g.expired(state, now) {
+			delete(g.triplets, t)
+		}
+	}
+	g.swept = now
+}
+
+func (g *Greylist) expired(state *TripletState, now time.Time) bool {
+	if state.Passed {
+		return g.PassedTTL > 0 && now.Sub(state.LastSeen) >= g.PassedTTL
+	}
+	return g.RetryWindow > 0 && now.Sub(state.FirstSeen) >= g.RetryWindow
+}
+
+func (g *Greylist) Remove(t Triplet) {
+	g.mu.Lock()
+	delete(g.triplets, t)
+	g.mu.Unlock()
+}
+
+func (g *Greylist) Clear() {
+	g.mu.Lock()
+	g.triplets = make(map[Triplet]*TripletState)
+	g.mu.Unlock()
+}
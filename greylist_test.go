@@ -0,0 +1,107 @@
+package helo
+
+import (
+	"net/smtp"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+const (
+	GreylistTestHost = ":9993"
+)
+
+func TestGreylist(t *testing.T) {
+
+	gs := NewSmtpServer(GreylistTestHost)
+	gs.SetGreylist(NewGreylist(100 * time.Millisecond))
+
+	if err := gs.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Stop()
+
+	rcpt := func() error {
+		c, err := smtp.Dial(GreylistTestHost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Quit()
+		if err := c.Mail("sender@example.org"); err != nil {
+			t.Fatal(err)
+		}
+		return c.Rcpt("recipient@example.net")
+	}
+
+	for i := 0; i < 2; i++ {
+		err := rcpt()
+		if e, ok := err.(*textproto.Error); !ok || e.Code != 451 {
+			t.Fatalf("attempt %d: expected 451, got %v", i, err)
+		}
+	}
+
+	triplets := gs.greylist.Triplets()
+	if len(triplets) != 1 {
+		t.Fatalf("expected 1 triplet, got %d", len(triplets))
+	}
+	for triplet, state := range triplets {
+		if triplet.From != "sender@example.org" || triplet.To != "recipient@example.net" {
+			t.Errorf("unexpected triplet %+v", triplet)
+		}
+		if state.Attempts != 2 || state.Passed {
+			t.Errorf("unexpected state %+v", state)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if err := rcpt(); err != nil {
+		t.Errorf("expected retry to be accepted, got %v", err)
+	}
+
+	gs.greylist.Clear()
+
+	if err := rcpt(); err == nil {
+		t.Error("expected cleared triplet to be greylisted again")
+	}
+
+}
+
+func TestGreylistExpiry(t *testing.T) {
+
+	g := NewGreylist(0)
+	g.RetryWindow = 50 * time.Millisecond
+	g.PassedTTL = 100 * time.Millisecond
+
+	passed := Triplet{"127.0.0.1", "sender@example.org", "passed@example.net"}
+	seen := Triplet{"127.0.0.1", "sender@example.org", "seen@example.net"}
+
+	if g.Check(passed) || !g.Check(passed) {
+		t.Fatal("expected the retry to pass")
+	}
+	if g.Check(seen) {
+		t.Fatal("expected the first attempt to be greylisted")
+	}
+
+	// not retried within the window
+	time.Sleep(60 * time.Millisecond)
+
+	triplets := g.Triplets()
+	if _, ok := triplets[seen]; ok || len(triplets) != 1 {
+		t.Errorf("expected only the passed triplet, got %+v", triplets)
+	}
+	if g.Check(seen) {
+		t.Error("expected an expired triplet to start over")
+	}
+
+	// not seen again within the ttl
+	time.Sleep(110 * time.Millisecond)
+
+	if triplets := g.Triplets(); len(triplets) != 0 {
+		t.Errorf("expected no triplets, got %+v", triplets)
+	}
+	if g.Check(passed) {
+		t.Error("expected an expired pass to be greylisted again")
+	}
+
+}
@@ -1,15 +1,48 @@
 package helo
 
 import (
+	"crypto/tls"
+	"io"
 	"net"
 	"net/mail"
+	"time"
 )
 
 func (s *SmtpServer) handleSession(conn net.Conn) {
-	defer conn.Close()
+	// closed as whatever it ends up being after STARTTLS
+	defer func() { conn.Close() }()
 
-	r := s.newReader(conn)
-	w := s.newWriter(conn)
+	outcome := OutcomeDisconnected
+	s.metrics.connected()
+
+	transcript := s.newTranscript()
+
+	c := s.newSession(conn)
+	s.registry.add(c)
+	defer func() {
+		s.registry.remove(c)
+		if c.wasKilled() {
+			outcome = OutcomeKilled
+		}
+		s.metrics.disconnected(outcome)
+		s.endSession(c, outcome)
+		c.trace.end(outcome)
+	}()
+	defer s.saveTranscript(c, transcript)
+	r := s.newReader(conn, c, transcript)
+	w := s.newWriter(conn, c, transcript)
+	// whichever they are after STARTTLS
+	defer func() {
+		r.release()
+		w.release()
+	}()
+
+	if s.script != nil {
+		outcome = OutcomeScript
+		c.setState(StateScript)
+		s.runScript(r, w)
+		return
+	}
 
 	// SMTP COMMANDS
 	// http://tools.ietf.org/html/rfc821#page-29
@@ -17,20 +50,40 @@ func (s *SmtpServer) handleSession(conn net.Conn) {
 	// SEQUENCING OF COMMANDS AND REPLIES
 	// http://tools.ietf.org/html/rfc821#page-37
 
-	type Message struct {
-		To   string
-		From string
-		Data string
+	var (
+		message   = &Message{}
+		helo      string
+		sessionID = c.id
+		started   time.Time
+		identity  string
+	)
+
+	_, secure := conn.(*tls.Conn)
+	if secure {
+		// done up front rather than on the first write to be timed
+		c.setState(StateTLS)
+		start := time.Now()
+		err := conn.(*tls.Conn).Handshake()
+		c.trace.record("smtp.tls_handshake", start, nil, err)
+		if err != nil {
+			outcome = OutcomeError
+			c.log.Warn("tls handshake failed", "err", err)
+			return
+		}
+		c.stats.TLSHandshake = time.Since(start)
 	}
 
-	var message = &Message{}
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
 
 	// CONNECTION ESTABLISHMENT
 	// S: 220 helo Service ready
 	// F: 421 helo Service not available
 	w.WriteReplyCode(ReplyServiceReady)
+	c.stats.Greeting = time.Since(c.stats.Started)
 
 	for {
+		c.setState(transactionState(helo, message))
+
 		command, arg, err := r.ReadCommand()
 
 		switch err {
@@ -41,7 +94,10 @@ func (s *SmtpServer) handleSession(conn net.Conn) {
 			w.WriteReplyCode(ReplySyntaxErrorCommandUnrecognized)
 			continue
 		default:
-			s.log(err)
+			if err != io.EOF {
+				outcome = OutcomeError
+			}
+			c.log.Warn("read failed", "err", err)
 			w.WriteReplyCode(ReplyRequestedActionAbortedInProcessing)
 			return
 		case nil:
@@ -71,6 +127,11 @@ func (s *SmtpServer) handleSession(conn net.Conn) {
 			// E: 500 Syntax error, command unrecognized
 			// E: 501 Syntax error in parameters or arguments
 			// E: 504 Command parameter not implemented
+			if s.lmtp {
+				w.WriteReplyCode(ReplySyntaxErrorCommandUnrecognized)
+				break
+			}
+			helo = arg
 			w.WriteReply(ReplyOk, "helo at your service")
 
 		case CommandMail:
@@ -105,13 +166,26 @@ func (s *SmtpServer) handleSession(conn net.Conn) {
 			// F: 451 Requested action aborted: error in processing
 			// F: 452 Requested action not taken: insufficient system storage
 			// F: 552 Requested mail action aborted: exceeded storage allocation
-			matches := from_email_regexp.FindStringSubmatch(arg)
-			if len(matches) == 2 {
-				if len(message.From) == 0 {
-					message.From = matches[1]
+			from, ok := parseFrom(arg)
+			if s.submission != nil {
+				if identity == "" {
+					w.WriteReplyCode(ReplyAuthenticationRequired)
+					break
+				}
+				if ok && !s.submission.allowed(identity, from) {
+					w.WriteReply(ReplyRequestedActionNotTakenMailboxNameNotAllowed, "Sender not allowed for %s", identity)
+					break
+				}
+			}
+			if ok {
+				// the null reverse-path leaves From empty
+				if message.MailArg == "" {
+					message.From = from
+					started = time.Now()
 				} else {
-					message.From += "," + matches[1]
+					message.From += "," + from
 				}
+				message.MailArg = arg
 				w.WriteReplyCode(ReplyOk)
 			} else {
 				w.WriteReplyCode(ReplySyntaxErrorInParametersOrArguments)
@@ -165,13 +239,18 @@ func (s *SmtpServer) handleSession(conn net.Conn) {
 			// F: 551 User not local; please try %s
 			// F: 552 Requested mail action aborted: exceeded storage allocation
 			// F: 553 Requested action not taken: mailbox name not allowed
-			matches := to_email_regexp.FindStringSubmatch(arg)
-			if len(matches) == 2 {
-				message.To = matches[1]
-				w.WriteReplyCode(ReplyOk)
-			} else {
+			to, ok := parseTo(arg)
+			if !ok {
 				w.WriteReplyCode(ReplySyntaxErrorInParametersOrArguments)
+				break
+			}
+			if s.greylist != nil && !s.lmtp && !s.greylist.Check(Triplet{ip, message.From, to}) {
+				w.WriteReply(ReplyRequestedActionAbortedInProcessing, "Greylisted, please try again later")
+				break
 			}
+			message.To = append(message.To, to)
+			message.RcptArgs = append(message.RcptArgs, arg)
+			w.WriteReplyCode(ReplyOk)
 
 		case CommandData:
 			// DATA <CRLF>
@@ -255,24 +334,71 @@ func (s *SmtpServer) handleSession(conn net.Conn) {
 			// E: 503 Bad sequence of commands
 			// F: 451 Requested action aborted: error in processing
 			// F: 554 Transaction failed
-			if len(message.From) == 0 || len(message.To) == 0 {
+			if message.MailArg == "" || len(message.To) == 0 {
 				w.WriteReplyCode(ReplyBadSequenceOfCommands)
 			} else {
 				w.WriteReplyCode(ReplyStartMailInputEndWith)
 
-				switch data, err := r.ReadData(); err {
+				c.setState(StateData)
+				start := time.Now()
+				data, err := r.ReadData()
+				c.trace.data(start, data, err)
+
+				message.Data = data
+				if err == nil && s.submission != nil && s.submission.FixHeaders {
+					message.Data = s.submission.fixHeaders(data)
+				}
+				message.SessionID = sessionID
+				message.Helo = helo
+				message.RemoteAddr = conn.RemoteAddr().String()
+				message.Received = time.Now()
+				message.Transcript = transcript
+
+				var reply Reply
+
+				switch err {
 				case MessageSizeError:
-					w.WriteReplyCode(ReplyRequestedMailActionAbortedExceededStorageAllocation)
+					reply = ReplyRequestedMailActionAbortedExceededStorageAllocation
 				case BadSyntaxError:
-					w.WriteReplyCode(ReplyTransactionFailed)
+					reply = ReplyTransactionFailed
 				default:
-					s.log(err)
+					outcome = OutcomeError
+					c.log.Warn("data read failed", "err", err)
 					w.WriteReplyCode(ReplyRequestedActionAbortedInProcessing)
 					return
 				case nil:
-					message.Data = data
-					message = &Message{}
-					w.WriteReplyCode(ReplyOk)
+					reply = ReplyOk
+					s.metrics.message(len(data))
+					c.stats.Messages++
+				}
+
+				// lmtp delivers and replies for each recipient in turn
+				messages := []*Message{message}
+				if s.lmtp {
+					messages = messages[:0]
+					for i, rcpt := range message.To {
+						rcptMessage := *message
+						rcptMessage.To = []string{rcpt}
+						rcptMessage.RcptArgs = message.RcptArgs[i : i+1]
+						messages = append(messages, &rcptMessage)
+					}
+				}
+
+				replies := make([]Reply, len(messages))
+				for i, m := range messages {
+					replies[i] = reply
+					if reply == ReplyOk {
+						replies[i] = s.deliver(c, m)
+					}
+					if s.journal != nil {
+						s.journal.Record(newJournalEntry(m, replies[i], started))
+					}
+				}
+
+				// the transaction is over whatever the outcome
+				message = &Message{}
+				for _, reply := range replies {
+					w.WriteReplyCode(reply)
 				}
 			}
 
@@ -511,6 +637,7 @@ func (s *SmtpServer) handleSession(conn net.Conn) {
 			//
 			// S: 221 helo Service closing transmission channel
 			// E: 500 Syntax error, command unrecognized
+			outcome = OutcomeQuit
 			w.WriteReplyCode(ReplyServiceClosingTransmissionChannel)
 			return
 
@@ -543,16 +670,34 @@ func (s *SmtpServer) handleSession(conn net.Conn) {
 			w.WriteReplyCode(ReplyCommandNotImplemented)
 
 		// esmtp:
-		case CommandEhlo:
+		case CommandEhlo, CommandLhlo:
 			// EHLO <SP> <domain> <CRLF>
 			// Response bnf
 			// ehlo-ok-rsp  ::=      "250"    domain [ SP greeting ] CR LF
 			//                / (    "250-"   domain [ SP greeting ] CR LF
 			//                    *( "250-"      ehlo-line           CR LF )
 			//                       "250"    SP ehlo-line           CR LF   )
+			//
+			// LHLO <SP> <domain> <CRLF>
+			// Takes the place of HELO and EHLO in lmtp, RFC 2033
+			if s.lmtp != (command == CommandLhlo) {
+				w.WriteReplyCode(ReplySyntaxErrorCommandUnrecognized)
+				break
+			}
+			helo = arg
 			w.WriteContinuedReply(ReplyOk, "helo at your service")
 			// SIZE — Message size declaration, RFC 1870
 			w.WriteContinuedReply(ReplyOk, "SIZE %d", MaxMessageSize)
+			if s.submission != nil {
+				if !secure && s.submission.TLSConfig != nil {
+					// STARTTLS — Transport layer security, RFC 3207
+					w.WriteContinuedReply(ReplyOk, "STARTTLS")
+				}
+				if secure {
+					// AUTH — Authenticated SMTP, RFC 4954
+					w.WriteContinuedReply(ReplyOk, "AUTH PLAIN LOGIN")
+				}
+			}
 			// SMTPUTF8 — Allow UTF-8 encoding in mailbox names and header fields, RFC 6531
 			w.WriteReply(ReplyOk, "SMTPUTF8")
 
@@ -563,8 +708,18 @@ func (s *SmtpServer) handleSession(conn net.Conn) {
 			w.WriteReplyCode(ReplyCommandNotImplemented)
 			// ATRN — Authenticated TURN for On-Demand Mail Relay, RFC 2645
 		case CommandAuth:
-			w.WriteReplyCode(ReplyCommandNotImplemented)
 			// AUTH — Authenticated SMTP, RFC 4954
+			switch {
+			case s.submission == nil:
+				w.WriteReplyCode(ReplyCommandNotImplemented)
+			case !secure:
+				w.WriteReplyCode(ReplyEncryptionRequired)
+			case identity != "" || message.MailArg != "":
+				w.WriteReplyCode(ReplyBadSequenceOfCommands)
+			default:
+				c.setState(StateAuth)
+				identity = s.authenticate(r, w, arg)
+			}
 		case CommandChunking:
 			w.WriteReplyCode(ReplyCommandNotImplemented)
 			// CHUNKING — Chunking, RFC 3030
@@ -578,8 +733,38 @@ func (s *SmtpServer) handleSession(conn net.Conn) {
 			w.WriteReplyCode(ReplyCommandNotImplemented)
 			// PIPELINING — Command pipelining, RFC 2920
 		case CommandStarttls:
-			w.WriteReplyCode(ReplyCommandNotImplemented)
 			// STARTTLS — Transport layer security, RFC 3207 (2002)
+			if s.submission == nil || s.submission.TLSConfig == nil {
+				w.WriteReplyCode(ReplyCommandNotImplemented)
+				break
+			}
+			if secure {
+				w.WriteReplyCode(ReplyBadSequenceOfCommands)
+				break
+			}
+			w.WriteReply(ReplyServiceReady, "Ready to start TLS")
+
+			c.setState(StateTLS)
+			start := time.Now()
+			tlsConn := tls.Server(conn, s.submission.TLSConfig)
+			err := tlsConn.Handshake()
+			c.trace.record("smtp.tls_handshake", start, nil, err)
+			if err != nil {
+				outcome = OutcomeError
+				c.log.Warn("tls handshake failed", "err", err)
+				return
+			}
+			c.stats.TLSHandshake = time.Since(start)
+			conn = tlsConn
+			secure = true
+			r.release()
+			w.release()
+			r = s.newReader(conn, c, transcript)
+			w = s.newWriter(conn, c, transcript)
+
+			// the client starts over, RFC 3207 section 4.2
+			helo = ""
+			message = &Message{}
 
 		default:
 			w.WriteReplyCode(ReplySyntaxErrorCommandUnrecognized)
@@ -1,19 +1,55 @@
 package helo
 
 import (
-	"bufio"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"log"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type (
 	SmtpServer struct {
-		host    string
-		logger  *log.Logger
-		running bool
+		host          string
+		logger        *slog.Logger
+		greylist      *Greylist
+		script        *Script
+		store         *Store
+		backend       Backend
+		journal       *Journal
+		submission    *Submission
+		metrics       *Metrics
+		transcriptDir string
+		stats         serverStats
+		exporter      SpanExporter
+		registry      *Registry
+		api           *http.Server
+		listener      net.Listener
+		running       atomic.Bool
+		lmtp          bool
+	}
+	// session is the state of one connection shared by its reader and
+	// writer.
+	session struct {
+		id    string
+		conn  net.Conn // as accepted, to be killed by
+		log   *slog.Logger
+		since time.Time // when the command was read
+		trace *sessionTrace
+
+		// guarded by mu, being read by the registry
+		mu     sync.Mutex
+		verb   string // of the command being answered
+		state  string
+		stats  SessionStats
+		killed bool
 	}
 	SmtpsServer struct {
 		*SmtpServer
@@ -29,40 +65,89 @@ var (
 func NewSmtpServer(host string) *SmtpServer {
 	return &SmtpServer{
 		host:   host,
-		logger: log.New(os.Stdout, "", log.LstdFlags|log.Lmicroseconds),
+		logger: slog.New(&legacyHandler{log.New(os.Stdout, "", log.LstdFlags|log.Lmicroseconds)}),
 	}
 }
 
+// NewLmtpServer returns a server speaking LMTP (RFC 2033), as a local
+// delivery agent would: clients greet with LHLO instead of HELO or
+// EHLO, there is no greylisting, and the end of data is answered once
+// per recipient, each delivered as its own message.
+func NewLmtpServer(host string) *SmtpServer {
+	s := NewSmtpServer(host)
+	s.lmtp = true
+	return s
+}
+
 func NewSmtpsServer(host, cert, key string) *SmtpsServer {
 	return &SmtpsServer{NewSmtpServer(host), cert, key}
 }
 
-func (s *SmtpServer) SetLogger(logger *log.Logger) {
-	s.logger = logger
+func (s *SmtpServer) SetGreylist(greylist *Greylist) {
+	s.greylist = greylist
 }
 
-func (s *SmtpServer) newReader(conn net.Conn) *Reader {
-	return &Reader{bufio.NewReader(conn), s}
+func (s *SmtpServer) SetScript(script *Script) {
+	s.script = script
 }
 
-func (s *SmtpServer) newWriter(conn net.Conn) *Writer {
-	return &Writer{conn, s}
+// SetStore keeps accepted messages in store, each along with the
+// transcript of the session that delivered it.
+func (s *SmtpServer) SetStore(store *Store) {
+	s.store = store
 }
 
-func (s *SmtpServer) log(data interface{}) {
-	if s.logger != nil {
-		s.logger.Println(data)
+func (s *SmtpServer) Store() *Store {
+	return s.store
+}
+
+// SetBackend sets where accepted messages are delivered.  When the
+// backend returns an error the client is sent a 451, or the code of a
+// *ReplyError, and the message is not stored.
+func (s *SmtpServer) SetBackend(backend Backend) {
+	s.backend = backend
+}
+
+func (s *SmtpServer) SetJournal(journal *Journal) {
+	s.journal = journal
+}
+
+// newTranscript returns a transcript for a new session when captured
+// messages are stored or transcripts saved, and nil otherwise.
+func (s *SmtpServer) newTranscript() *Transcript {
+	if s.store == nil && s.transcriptDir == "" {
+		return nil
 	}
+	return &Transcript{}
 }
-func (s *SmtpServer) logf(messagef string, data ...interface{}) {
-	if s.logger != nil {
-		s.logger.Printf(messagef, data...)
+
+// deliver hands m to the backend and stores it once accepted,
+// returning the reply for the client.
+func (s *SmtpServer) deliver(c *session, m *Message) Reply {
+
+	if s.backend != nil {
+		if err := s.backend.Deliver(m); err != nil {
+			c.log.Warn("delivery failed", "err", err)
+			return replyFor(err)
+		}
+	}
+	if s.store != nil {
+		s.store.Add(m)
 	}
+
+	return ReplyOk
+
+}
+
+func newSessionID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
 }
 
 func (s *SmtpServer) Start() error {
 
-	if s.running {
+	if s.running.Load() {
 		return AlreadyRunningError
 	}
 
@@ -71,16 +156,19 @@ func (s *SmtpServer) Start() error {
 		return err
 	}
 
-	s.log("helo smtp starting up.")
-	s.logf("Listening on %s", s.host)
+	s.logger.Info("helo smtp starting up", "addr", l.Addr().String())
 
-	s.running = true
+	s.listener = l
+	s.running.Store(true)
 
 	go func() {
-		for s.running {
+		for {
 			conn, err := l.Accept()
 			if err != nil {
-				s.log(err)
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				s.logger.Warn("accept failed", "err", err)
 				continue
 			}
 			go s.handleSession(conn)
@@ -93,7 +181,7 @@ func (s *SmtpServer) Start() error {
 
 func (s *SmtpsServer) Start() error {
 
-	if s.running {
+	if s.running.Load() {
 		return AlreadyRunningError
 	}
 
@@ -111,16 +199,19 @@ func (s *SmtpsServer) Start() error {
 		return err
 	}
 
-	s.log("helo smtps starting up.")
-	s.logf("Listening on %s", s.host)
+	s.logger.Info("helo smtps starting up", "addr", tlsl.Addr().String())
 
-	s.running = true
+	s.listener = tlsl
+	s.running.Store(true)
 
 	go func() {
-		for s.running {
+		for {
 			conn, err := tlsl.Accept()
 			if err != nil {
-				s.log(err)
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				s.logger.Warn("accept failed", "err", err)
 				continue
 			}
 			go s.handleSession(conn)
@@ -131,7 +222,22 @@ func (s *SmtpsServer) Start() error {
 
 }
 
+// Addr returns the address the server is listening on, which is
+// useful when started on port 0.
+func (s *SmtpServer) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
 func (s *SmtpServer) Stop() {
-	s.log("helo shutting down")
-	s.running = false
+	s.logger.Info("helo shutting down")
+	s.running.Store(false)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.api != nil {
+		s.api.Close()
+	}
 }
@@ -1,9 +1,11 @@
 package helo
 
 import (
+	"bufio"
 	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
 	"net/smtp"
 	"testing"
 )
@@ -209,3 +211,120 @@ func BenchmarkSendSmtps(b *testing.B) {
 	}
 
 }
+
+// BenchmarkSession measures the server side of a trivial session over
+// an in memory connection, without the cost of a real client.
+func BenchmarkSession(b *testing.B) {
+
+	server := NewSmtpServer("")
+	server.SetLogger(nil)
+
+	steps := [][]byte{
+		nil,
+		[]byte("EHLO localhost\r\n"),
+		[]byte("MAIL FROM:<sender@example.org>\r\n"),
+		[]byte("RCPT TO:<recipient@example.net>\r\n"),
+		[]byte("DATA\r\n"),
+		[]byte("This is the email body\r\n.\r\n"),
+		[]byte("QUIT\r\n"),
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+
+		client, conn := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			server.handleSession(conn)
+			close(done)
+		}()
+
+		r := bufio.NewReader(client)
+		for _, step := range steps {
+			// an empty write would block on the pipe
+			if step != nil {
+				if _, err := client.Write(step); err != nil {
+					b.Fatal(err)
+				}
+			}
+			for {
+				line, err := r.ReadSlice('\n')
+				if err != nil {
+					b.Fatal(err)
+				}
+				if line[3] != '-' {
+					break
+				}
+			}
+		}
+
+		client.Close()
+		<-done
+
+	}
+
+}
+
+type (
+	// benchConn reads the same line over and over and discards what is
+	// written.
+	benchConn struct {
+		net.Conn
+		line []byte
+		off  int
+	}
+)
+
+func (c *benchConn) Read(p []byte) (int, error) {
+	n := copy(p, c.line[c.off:])
+	c.off = (c.off + n) % len(c.line)
+	return n, nil
+}
+
+func (c *benchConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (c *benchConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25}
+}
+
+func BenchmarkReadCommand(b *testing.B) {
+
+	server := NewSmtpServer("")
+	server.SetLogger(nil)
+
+	conn := &benchConn{line: []byte("MAIL FROM:<sender@example.org>\r\n")}
+	r := server.newReader(conn, server.newSession(conn), nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, _, err := r.ReadCommand(); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+}
+
+func BenchmarkWriteReplyCode(b *testing.B) {
+
+	server := NewSmtpServer("")
+	server.SetLogger(nil)
+
+	conn := &benchConn{}
+	w := server.newWriter(conn, server.newSession(conn), nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := w.WriteReplyCode(ReplyOk); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+}
@@ -0,0 +1,217 @@
+// Package helotest provides helo servers for use in go test suites,
+// in the spirit of net/http/httptest.
+package helotest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jasonmoo/helo"
+)
+
+type (
+	// Server is a helo server listening on an ephemeral loopback port
+	// that captures every message it accepts.  It is stopped when the
+	// test that created it completes.
+	Server struct {
+		*helo.SmtpServer
+
+		// Addr is the host:port the server is listening on.
+		Addr string
+
+		// Timeout bounds how long ExpectMessageTo waits for a message.
+		Timeout time.Duration
+
+		// TLSConfig trusts the generated certificate of a server
+		// created with NewTLSServer and is nil otherwise.
+		TLSConfig *tls.Config
+
+		t          testing.TB
+		transcript *transcript
+	}
+	transcript struct {
+		mu  sync.Mutex
+		buf bytes.Buffer
+	}
+)
+
+const (
+	DefaultTimeout = 2 * time.Second
+
+	host = "127.0.0.1:0"
+)
+
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+
+	s := newServer(t, helo.NewSmtpServer(host))
+	if err := s.SmtpServer.Start(); err != nil {
+		t.Fatalf("helotest: %s", err)
+	}
+
+	return s.started()
+}
+
+// NewTLSServer starts an smtps server with a freshly generated
+// self signed certificate for 127.0.0.1 and localhost.
+func NewTLSServer(t testing.TB) *Server {
+	t.Helper()
+
+	certificate, cert, key, err := generateCert(t.TempDir())
+	if err != nil {
+		t.Fatalf("helotest: %s", err)
+	}
+
+	ss := helo.NewSmtpsServer(host, cert, key)
+
+	s := newServer(t, ss.SmtpServer)
+	if err := ss.Start(); err != nil {
+		t.Fatalf("helotest: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+	s.TLSConfig = &tls.Config{
+		RootCAs:    pool,
+		ServerName: "127.0.0.1",
+	}
+
+	return s.started()
+}
+
+func newServer(t testing.TB, ss *helo.SmtpServer) *Server {
+
+	s := &Server{
+		SmtpServer: ss,
+		Timeout:    DefaultTimeout,
+		t:          t,
+		transcript: &transcript{},
+	}
+
+	ss.SetLogger(log.New(s.transcript, "", log.Lmicroseconds))
+	ss.SetStore(helo.NewStore(0))
+
+	return s
+
+}
+
+func (s *Server) started() *Server {
+	s.Addr = s.SmtpServer.Addr().String()
+	s.t.Cleanup(s.SmtpServer.Stop)
+	return s
+}
+
+// Messages returns every message captured so far.
+func (s *Server) Messages() []*helo.Message {
+	return s.Store().Messages()
+}
+
+// Transcript returns the smtp conversation logged by the server.
+func (s *Server) Transcript() string {
+	return s.transcript.String()
+}
+
+// ExpectMessageTo waits for a message addressed to addr and fails
+// the test with the server transcript if none arrives in time.
+func (s *Server) ExpectMessageTo(addr string) *helo.Message {
+	s.t.Helper()
+
+	m, err := s.Store().WaitFor(func(m *helo.Message) bool {
+		for _, to := range m.To {
+			if strings.EqualFold(to, addr) {
+				return true
+			}
+		}
+		return false
+	}, s.Timeout)
+
+	if err != nil {
+		s.t.Fatalf("helotest: expected a message to %s within %s, got %d message(s)\n%s", addr, s.Timeout, s.Store().Len(), s.Transcript())
+	}
+
+	return m
+}
+
+// ExpectNoMessages fails the test with the server transcript if any
+// message has been captured.
+func (s *Server) ExpectNoMessages() {
+	s.t.Helper()
+
+	if n := s.Store().Len(); n > 0 {
+		s.t.Fatalf("helotest: expected no messages, got %d\n%s", n, s.Transcript())
+	}
+}
+
+func (t *transcript) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.buf.Write(p)
+}
+
+func (t *transcript) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.buf.String()
+}
+
+func generateCert(dir string) (*x509.Certificate, string, string, error) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"helotest"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		DNSNames:     []string{"localhost"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		return nil, "", "", err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return nil, "", "", err
+	}
+
+	return certificate, certPath, keyPath, nil
+
+}
@@ -0,0 +1,70 @@
+package helotest
+
+import (
+	"crypto/tls"
+	"net/smtp"
+	"strings"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+
+	s := NewServer(t)
+	s.ExpectNoMessages()
+
+	err := smtp.SendMail(s.Addr, nil, "sender@example.org", []string{"recipient@example.net"}, []byte("Subject: hi\r\n\r\nbody"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := s.ExpectMessageTo("Recipient@example.net")
+	if m.Subject() != "hi" {
+		t.Errorf("unexpected subject %q", m.Subject())
+	}
+	if len(s.Messages()) != 1 {
+		t.Errorf("expected 1 message, got %d", len(s.Messages()))
+	}
+	if !strings.Contains(s.Transcript(), "RCPT TO:<recipient@example.net>") {
+		t.Errorf("expected RCPT in transcript:\n%s", s.Transcript())
+	}
+
+}
+
+func TestTLSServer(t *testing.T) {
+
+	s := NewTLSServer(t)
+
+	conn, err := tls.Dial("tcp", s.Addr, s.TLSConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := smtp.NewClient(conn, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Mail("sender@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("recipient@example.net"); err != nil {
+		t.Fatal(err)
+	}
+	wc, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wc.Write([]byte("body")); err != nil {
+		t.Fatal(err)
+	}
+	if err := wc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Error(err)
+	}
+
+	s.ExpectMessageTo("recipient@example.net")
+
+}
@@ -0,0 +1,154 @@
+package helo
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type (
+	// Journal appends one json line per completed transaction.
+	// Entries are queued and written by a separate goroutine through a
+	// buffer that is flushed whenever the queue runs empty.
+	Journal struct {
+		w       io.Writer
+		buf     *bufio.Writer
+		entries chan *JournalEntry
+		done    chan struct{}
+
+		mu     sync.Mutex
+		closed bool
+		err    error
+	}
+	JournalEntry struct {
+		Time       time.Time `json:"time"`
+		SessionID  string    `json:"session_id"`
+		RemoteAddr string    `json:"remote_addr"`
+		Helo       string    `json:"helo"`
+		Mail       string    `json:"mail"`
+		Rcpt       []string  `json:"rcpt"`
+		Size       int       `json:"size"`
+		Digest     string    `json:"digest"`
+		Reply      Reply     `json:"reply"`
+		Duration   float64   `json:"duration_ms"`
+	}
+)
+
+const (
+	journal_queue_size  = 1 << 12
+	journal_buffer_size = 64 << 10
+)
+
+// OpenJournal appends to the journal file at path, creating it if
+// needed.
+func OpenJournal(path string) (*Journal, error) {
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewJournal(f), nil
+
+}
+
+// NewJournal writes entries to w.  If w is an io.Closer it is closed
+// by Close.
+func NewJournal(w io.Writer) *Journal {
+
+	j := &Journal{
+		w:       w,
+		buf:     bufio.NewWriterSize(w, journal_buffer_size),
+		entries: make(chan *JournalEntry, journal_queue_size),
+		done:    make(chan struct{}),
+	}
+
+	go j.run()
+
+	return j
+
+}
+
+func newJournalEntry(m *Message, reply Reply, started time.Time) *JournalEntry {
+
+	digest := sha256.Sum256([]byte(m.Data))
+
+	return &JournalEntry{
+		Time:       m.Received,
+		SessionID:  m.SessionID,
+		RemoteAddr: m.RemoteAddr,
+		Helo:       m.Helo,
+		Mail:       m.MailArg,
+		Rcpt:       m.RcptArgs,
+		Size:       len(m.Data),
+		Digest:     "sha256:" + hex.EncodeToString(digest[:]),
+		Reply:      reply,
+		Duration:   float64(m.Received.Sub(started)) / float64(time.Millisecond),
+	}
+
+}
+
+// Record queues an entry, blocking only when the queue is full.
+// Entries recorded after Close are dropped.
+func (j *Journal) Record(e *JournalEntry) {
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if !j.closed {
+		j.entries <- e
+	}
+
+}
+
+// Close writes any queued entries and returns the first write error.
+func (j *Journal) Close() error {
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closed {
+		return j.err
+	}
+
+	j.closed = true
+	close(j.entries)
+	<-j.done
+
+	if c, ok := j.w.(io.Closer); ok {
+		if err := c.Close(); err != nil && j.err == nil {
+			j.err = err
+		}
+	}
+
+	return j.err
+
+}
+
+func (j *Journal) run() {
+
+	defer close(j.done)
+
+	enc := json.NewEncoder(j.buf)
+
+	for e := range j.entries {
+		if err := enc.Encode(e); err != nil && j.err == nil {
+			j.err = err
+		}
+		if len(j.entries) == 0 {
+			if err := j.buf.Flush(); err != nil && j.err == nil {
+				j.err = err
+			}
+		}
+	}
+
+	if err := j.buf.Flush(); err != nil && j.err == nil {
+		j.err = err
+	}
+
+}
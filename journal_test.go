@@ -0,0 +1,75 @@
+package helo
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	JournalTestHost = ":9997"
+)
+
+func TestJournal(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	js := NewSmtpServer(JournalTestHost)
+	js.SetJournal(j)
+
+	if err := js.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer js.Stop()
+
+	for i := 0; i < 2; i++ {
+		err := smtp.SendMail(JournalTestHost, nil, "sender@example.org", []string{"recipient@example.net"}, []byte("This is the email body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+
+	e := entries[0]
+	if e.Reply != ReplyOk || e.Helo != "localhost" || e.Mail != "FROM:<sender@example.org> SMTPUTF8" || len(e.Rcpt) != 1 {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if e.Size != len("This is the email body") || len(e.Digest) != len("sha256:")+64 {
+		t.Errorf("unexpected size or digest %+v", e)
+	}
+	if e.SessionID == "" || e.SessionID == entries[1].SessionID {
+		t.Errorf("expected distinct session ids, got %q and %q", e.SessionID, entries[1].SessionID)
+	}
+
+}
@@ -0,0 +1,73 @@
+package helo
+
+import (
+	"errors"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+const (
+	LmtpTestHost = ":9981"
+)
+
+func TestLmtp(t *testing.T) {
+
+	s := NewLmtpServer(LmtpTestHost)
+	s.SetStore(NewStore(0))
+	s.SetGreylist(NewGreylist(time.Hour))
+	s.SetBackend(BackendFunc(func(m *Message) error {
+		if m.To[0] == "full@example.net" {
+			return &ReplyError{ReplyRequestedActionNotTakenInsufficientSystemStorage, errors.New("mailbox full")}
+		}
+		return nil
+	}))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	c, err := textproto.Dial("tcp", LmtpTestHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	expect := func(code int, format string, args ...interface{}) {
+		t.Helper()
+		if format != "" {
+			if err := c.PrintfLine(format, args...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, _, err := c.ReadResponse(code); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect(220, "")
+	expect(500, "HELO localhost")
+	expect(500, "EHLO localhost")
+	expect(250, "LHLO localhost")
+	expect(250, "MAIL FROM:<sender@example.org>")
+	// no greylisting
+	expect(250, "RCPT TO:<a@example.net>")
+	expect(250, "RCPT TO:<full@example.net>")
+	expect(250, "RCPT TO:<b@example.net>")
+	expect(354, "DATA")
+
+	// a reply per recipient
+	expect(250, "Subject: lmtp\r\n\r\nThis is the email body\r\n.")
+	expect(452, "")
+	expect(250, "")
+	expect(221, "QUIT")
+
+	messages := s.Store().Messages()
+	if len(messages) != 2 {
+		t.Fatalf("expected a message per delivered recipient, got %d", len(messages))
+	}
+	if messages[0].To[0] != "a@example.net" || messages[1].To[0] != "b@example.net" || len(messages[1].To) != 1 {
+		t.Errorf("unexpected recipients %v %v", messages[0].To, messages[1].To)
+	}
+
+}
@@ -0,0 +1,121 @@
+package helo
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LOGGING
+//
+// Servers log through log/slog: starting and stopping at info, session
+// and delivery errors at warn, and every line read or written at debug.
+// Session records carry these attributes:
+//
+// session      the session id, as in Message.SessionID
+// remote_addr  the client address
+// direction    "<<<" read from the client, ">>>" written to it
+// verb         the command being read or answered
+// code         the reply code of lines written
+// data         the line or message data itself
+// err          the error, for warnings
+
+type (
+	// legacyHandler writes records to a *log.Logger in the format used
+	// before structured logging: lines read and written as the direction
+	// and the quoted data, anything else as the message followed by its
+	// attributes.  Session attributes are left out.
+	legacyHandler struct {
+		l *log.Logger
+	}
+)
+
+// SetLogger logs everything to logger in the plain format, or nothing
+// when logger is nil.
+func (s *SmtpServer) SetLogger(logger *log.Logger) {
+	s.logger = slog.New(&legacyHandler{logger})
+}
+
+// SetSlogger logs through logger, whose handler decides the format and
+// the level.
+func (s *SmtpServer) SetSlogger(logger *slog.Logger) {
+	s.logger = logger
+}
+
+func (s *SmtpServer) newSession(conn net.Conn) *session {
+	c := &session{id: newSessionID(), conn: conn, state: StateConnected}
+	c.log = s.logger.With("session", c.id, "remote_addr", conn.RemoteAddr().String())
+	c.stats = SessionStats{
+		ID:         c.id,
+		RemoteAddr: conn.RemoteAddr().String(),
+		Started:    time.Now(),
+		Commands:   make([]CommandStats, 0, 8),
+	}
+	c.trace = s.newSessionTrace(c)
+	return c
+}
+
+// traffic logs data read or written in the session at debug.
+func (c *session) traffic(direction Direction, data string) {
+
+	if !c.log.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+
+	attrs := []interface{}{"direction", string(direction), "verb", c.verb}
+	if direction == DirectionServer && len(data) >= 3 {
+		if code, err := strconv.Atoi(data[:3]); err == nil {
+			attrs = append(attrs, "code", code)
+		}
+	}
+	attrs = append(attrs, "data", data)
+
+	c.log.Debug("smtp", attrs...)
+
+}
+
+func (h *legacyHandler) Enabled(context.Context, slog.Level) bool {
+	return h.l != nil
+}
+
+func (h *legacyHandler) Handle(_ context.Context, r slog.Record) error {
+
+	var (
+		direction, data string
+		line            = []string{r.Message}
+	)
+
+	r.Attrs(func(a slog.Attr) bool {
+		switch a.Key {
+		case "direction":
+			direction = a.Value.String()
+		case "data":
+			data = a.Value.String()
+		case "verb", "code":
+		default:
+			line = append(line, a.Key+"="+a.Value.String())
+		}
+		return true
+	})
+
+	if direction != "" {
+		h.l.Printf("%s %q", direction, data)
+	} else {
+		h.l.Println(strings.Join(line, " "))
+	}
+
+	return nil
+
+}
+
+func (h *legacyHandler) WithAttrs([]slog.Attr) slog.Handler {
+	return h
+}
+
+func (h *legacyHandler) WithGroup(string) slog.Handler {
+	return h
+}
@@ -0,0 +1,115 @@
+package helo
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/smtp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	LogTestHost = ":9984"
+)
+
+type syncBuffer struct {
+	mu sync.Mutex
+	bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.Buffer.String()
+}
+
+func TestStructuredLog(t *testing.T) {
+
+	send := func(handler slog.Handler) {
+		s := NewSmtpServer(LogTestHost)
+		s.SetSlogger(slog.New(handler))
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Stop()
+		if err := smtp.SendMail(LogTestHost, nil, "sender@example.org", []string{"recipient@example.net"}, []byte("This is the email body")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var debug, info syncBuffer
+
+	send(slog.NewJSONHandler(&debug, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	var mail, reply map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(debug.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("%s: %q", err, line)
+		}
+		if record["direction"] == "<<<" && record["verb"] == "MAIL" {
+			mail = record
+		}
+		if record["direction"] == ">>>" && record["verb"] == "MAIL" {
+			reply = record
+		}
+	}
+
+	if mail == nil || mail["level"] != "DEBUG" || mail["session"] == "" || !strings.HasPrefix(mail["remote_addr"].(string), "127.0.0.1:") {
+		t.Errorf("unexpected MAIL record %v", mail)
+	}
+	if reply == nil || reply["code"] != float64(250) || reply["session"] != mail["session"] {
+		t.Errorf("unexpected MAIL reply record %v", reply)
+	}
+
+	// no traffic above debug
+	send(slog.NewTextHandler(&info, nil))
+
+	if !strings.Contains(info.String(), "helo smtp starting up") || strings.Contains(info.String(), "direction=") {
+		t.Errorf("unexpected records at info\n%s", info.String())
+	}
+
+}
+
+func TestLegacyLog(t *testing.T) {
+
+	var buf syncBuffer
+
+	s := NewSmtpServer(LogTestHost)
+	s.SetLogger(log.New(&buf, "", 0))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	if err := smtp.SendMail(LogTestHost, nil, "sender@example.org", []string{"recipient@example.net"}, []byte("This is the email body")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the session log ends with the QUIT reply
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if strings.Contains(buf.String(), "221 helo") {
+			break
+		}
+	}
+
+	for _, line := range []string{
+		`<<< "MAIL FROM:<sender@example.org> SMTPUTF8\r\n"`,
+		`>>> "250 OK\r\n"`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("missing %s in\n%s", line, buf.String())
+		}
+	}
+
+}
@@ -0,0 +1,123 @@
+package helo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// MaildirBackend delivers each message into a Maildir per
+	// recipient under root, ie root/<recipient>/{tmp,new,cur}.
+	MaildirBackend struct {
+		root  string
+		host  string
+		count uint64
+	}
+)
+
+var (
+	maildir_subdirs = []string{"tmp", "new", "cur"}
+
+	maildir_host_replacer = strings.NewReplacer("/", `\057`, ":", `\072`)
+	mailbox_name_replacer = strings.NewReplacer("/", "_", `\`, "_", "\x00", "_")
+)
+
+func NewMaildirBackend(root string) (*MaildirBackend, error) {
+
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	return &MaildirBackend{
+		root: root,
+		host: host,
+	}, nil
+
+}
+
+func (b *MaildirBackend) Deliver(m *Message) error {
+
+	// maildir messages are stored with unix line endings
+	data := []byte(strings.Replace(m.Stamped(b.host), "\r\n", "\n", -1))
+
+	for _, to := range m.To {
+		if err := b.deliver(MailboxName(to), data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// Path returns the maildir for a recipient.
+func (b *MaildirBackend) Path(recipient string) string {
+	return filepath.Join(b.root, MailboxName(recipient))
+}
+
+func (b *MaildirBackend) deliver(mailbox string, data []byte) error {
+
+	dir := filepath.Join(b.root, mailbox)
+	for _, sub := range maildir_subdirs {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+
+	name := b.uniqueName(len(data))
+	tmp := filepath.Join(dir, "tmp", name)
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(dir, "new", name))
+
+}
+
+// uniqueName follows http://cr.yp.to/proto/maildir.html
+func (b *MaildirBackend) uniqueName(size int) string {
+	now := time.Now()
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s,S=%d",
+		now.Unix(),
+		now.Nanosecond()/1000,
+		os.Getpid(),
+		atomic.AddUint64(&b.count, 1),
+		maildir_host_replacer.Replace(b.host),
+		size,
+	)
+}
+
+// MailboxName maps a recipient address to a safe directory name.
+func MailboxName(recipient string) string {
+	name := mailbox_name_replacer.Replace(strings.ToLower(recipient))
+	if name == "" || name == "." || name == ".." {
+		name = "_"
+	}
+	return name
+}
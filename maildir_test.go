@@ -0,0 +1,60 @@
+package helo
+
+import (
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	MaildirTestHost = ":9996"
+)
+
+func TestMaildirBackend(t *testing.T) {
+
+	b, err := NewMaildirBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ms := NewSmtpServer(MaildirTestHost)
+	ms.SetBackend(b)
+
+	if err := ms.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer ms.Stop()
+
+	rcpts := []string{"one@example.net", "Two@example.net"}
+	err = smtp.SendMail(MaildirTestHost, nil, "sender@example.org", rcpts, []byte("Subject: hi\r\n\r\nThis is the email body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rcpt := range rcpts {
+		files, err := filepath.Glob(filepath.Join(b.Path(rcpt), "new", "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 {
+			t.Fatalf("expected 1 message for %s, got %d", rcpt, len(files))
+		}
+		if tmp, _ := filepath.Glob(filepath.Join(b.Path(rcpt), "tmp", "*")); len(tmp) != 0 {
+			t.Errorf("expected empty tmp for %s, got %v", rcpt, tmp)
+		}
+
+		data, err := os.ReadFile(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(data), "Return-Path: <sender@example.org>\nReceived: from localhost (127.0.0.1:") {
+			t.Errorf("unexpected headers in %q", data)
+		}
+		if !strings.HasSuffix(string(data), "\nSubject: hi\n\nThis is the email body") {
+			t.Errorf("unexpected body in %q", data)
+		}
+	}
+
+}
@@ -0,0 +1,171 @@
+package helo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// MboxBackend appends each message to an mboxrd file, locking it
+	// with a dotlock while writing.  When Rotation is due the current
+	// file is renamed with a timestamp suffix and a new one started.
+	MboxBackend struct {
+		Rotation Rotation
+
+		path string
+		host string
+
+		mu      sync.Mutex
+		started time.Time
+	}
+)
+
+const (
+	mbox_lock_timeout = 10 * time.Second
+	mbox_lock_stale   = 5 * time.Minute
+)
+
+var (
+	MboxLockTimeoutError = errors.New("timed out waiting for mbox lock")
+)
+
+func NewMboxBackend(path string) (*MboxBackend, error) {
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	return &MboxBackend{
+		path:    path,
+		host:    host,
+		started: time.Now(),
+	}, nil
+
+}
+
+func (b *MboxBackend) Deliver(m *Message) error {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.lock(); err != nil {
+		return err
+	}
+	defer b.unlock()
+
+	if err := b.rotate(); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(b.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(MboxEntry(m, b.host)); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+
+}
+
+func (b *MboxBackend) rotate() error {
+
+	if !b.Rotation.enabled() {
+		return nil
+	}
+
+	info, err := os.Stat(b.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !b.Rotation.due(info.Size(), b.started) {
+		return nil
+	}
+
+	b.started = time.Now()
+
+	return os.Rename(b.path, b.path+"."+b.started.Format(rotation_suffix_format))
+
+}
+
+// lock takes a dotlock on the mbox, the one locking scheme every
+// mbox reader understands regardless of platform.
+func (b *MboxBackend) lock() error {
+
+	lock := b.path + ".lock"
+	deadline := time.Now().Add(mbox_lock_timeout)
+
+	for {
+		f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			return f.Close()
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+
+		if info, err := os.Stat(lock); err == nil && time.Since(info.ModTime()) > mbox_lock_stale {
+			os.Remove(lock)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return MboxLockTimeoutError
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+}
+
+func (b *MboxBackend) unlock() {
+	os.Remove(b.path + ".lock")
+}
+
+// MboxEntry formats a message as an mboxrd entry: a From_ line, the
+// stamped message with unix line endings and any line matching
+// ^>*From quoted with an extra >, followed by a blank line.
+func MboxEntry(m *Message, host string) []byte {
+
+	from := m.From
+	if len(from) == 0 {
+		from = "MAILER-DAEMON"
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From %s %s\n", from, m.Received.UTC().Format(time.ANSIC))
+
+	data := strings.Replace(m.Stamped(host), "\r\n", "\n", -1)
+	for _, line := range strings.SplitAfter(data, "\n") {
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			buf.WriteByte('>')
+		}
+		buf.WriteString(line)
+	}
+
+	if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+
+	return buf.Bytes()
+
+}
@@ -0,0 +1,103 @@
+package helo
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testMessage() *Message {
+	return &Message{
+		From:       "sender@example.org",
+		To:         []string{"recipient@example.net"},
+		Data:       "Subject: hi\r\n\r\nFrom here\r\n>From there\r\nnot From",
+		Helo:       "localhost",
+		RemoteAddr: "127.0.0.1:1234",
+		Received:   time.Date(2015, 7, 4, 12, 43, 35, 0, time.UTC),
+	}
+}
+
+func TestMboxEntry(t *testing.T) {
+
+	entry := string(MboxEntry(testMessage(), "mx.example.com"))
+
+	if !strings.HasPrefix(entry, "From sender@example.org Sat Jul  4 12:43:35 2015\nReturn-Path: <sender@example.org>\n") {
+		t.Errorf("unexpected From_ line in %q", entry)
+	}
+	if !strings.HasSuffix(entry, "\n\n>From here\n>>From there\nnot From\n\n") {
+		t.Errorf("unexpected quoting in %q", entry)
+	}
+
+}
+
+func TestMboxBackendRotation(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "mail", "inbox.mbox")
+
+	b, err := NewMboxBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Rotation.MaxSize = 1
+
+	for i := 0; i < 3; i++ {
+		if err := b.Deliver(testMessage()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, _ := filepath.Glob(path + "*")
+	if len(files) != 3 {
+		t.Errorf("expected current file and 2 rotated files, got %v", files)
+	}
+	if _, err := os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Error("expected lock to be released")
+	}
+
+}
+
+func TestEmlBackend(t *testing.T) {
+
+	dir := t.TempDir()
+
+	b, err := NewEmlBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Deliver(testMessage()); err != nil {
+		t.Fatal(err)
+	}
+
+	emls, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(emls) != 1 {
+		t.Fatalf("expected 1 eml, got %v", emls)
+	}
+
+	data, err := os.ReadFile(strings.TrimSuffix(emls[0], ".eml") + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.From != "sender@example.org" || envelope.To[0] != "recipient@example.net" {
+		t.Errorf("unexpected envelope %+v", envelope)
+	}
+
+	b.Rotation.MaxSize = 1
+	for i := 0; i < 2; i++ {
+		if err := b.Deliver(testMessage()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if dirs, _ := filepath.Glob(filepath.Join(dir, "*", "*.eml")); len(dirs) != 2 {
+		t.Errorf("expected 2 rotated emls, got %v", dirs)
+	}
+
+}
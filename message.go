@@ -0,0 +1,122 @@
+package helo
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+type (
+	// Message is a completed envelope as received by handleSession.
+	Message struct {
+		ID         string
+		SessionID  string
+		From       string
+		To         []string
+		Data       string
+		Helo       string
+		RemoteAddr string
+		Received   time.Time
+
+		// raw MAIL and RCPT arguments including any esmtp parameters
+		MailArg  string
+		RcptArgs []string
+
+		// Transcript of the session that delivered the message, set
+		// when the server stores messages.
+		Transcript *Transcript
+	}
+	// Envelope is the json representation of a message without its
+	// data.
+	Envelope struct {
+		ID         string    `json:"id,omitempty"`
+		From       string    `json:"from"`
+		To         []string  `json:"to"`
+		Helo       string    `json:"helo"`
+		RemoteAddr string    `json:"remote_addr"`
+		Received   time.Time `json:"received"`
+		Size       int       `json:"size"`
+	}
+	// Backend receives each message accepted by the server.  A
+	// backend returns a *ReplyError to choose the reply sent to the
+	// client, any other error is answered with a 451.
+	Backend interface {
+		Deliver(m *Message) error
+	}
+	// BackendFunc adapts a func to a Backend.
+	BackendFunc func(m *Message) error
+	ReplyError  struct {
+		Code Reply
+		Err  error
+	}
+)
+
+func (f BackendFunc) Deliver(m *Message) error {
+	return f(m)
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("%d %s", e.Code, e.Err)
+}
+
+func (e *ReplyError) Unwrap() error {
+	return e.Err
+}
+
+// replyFor maps a delivery error to the reply for the client.
+func replyFor(err error) Reply {
+	var re *ReplyError
+	if errors.As(err, &re) {
+		return re.Code
+	}
+	return ReplyRequestedActionAbortedInProcessing
+}
+
+func (m *Message) Envelope() Envelope {
+	return Envelope{
+		ID:         m.ID,
+		From:       m.From,
+		To:         m.To,
+		Helo:       m.Helo,
+		RemoteAddr: m.RemoteAddr,
+		Received:   m.Received,
+		Size:       len(m.Data),
+	}
+}
+
+// Header parses the header section of the message data.
+func (m *Message) Header() (mail.Header, error) {
+	msg, err := mail.ReadMessage(strings.NewReader(m.Data))
+	if err != nil {
+		return nil, err
+	}
+	return msg.Header, nil
+}
+
+func (m *Message) Subject() string {
+	header, err := m.Header()
+	if err != nil {
+		return ""
+	}
+	return DecodeHeader(header.Get("Subject"))
+}
+
+// Stamped returns the message data with the Return-Path and Received
+// lines prepended that the receiver inserts on final delivery, see
+// the DATA notes in handleSession.
+func (m *Message) Stamped(host string) string {
+	return "Return-Path: <" + m.From + ">\r\n" + m.TimeStamp(host) + m.Data
+}
+
+// TimeStamp returns the Received line the receiver inserts when it
+// accepts a message for relaying or final delivery.
+func (m *Message) TimeStamp(host string) string {
+	return fmt.Sprintf("Received: from %s (%s)\r\n\tby %s with SMTP;\r\n\t%s\r\n",
+		m.Helo,
+		m.RemoteAddr,
+		host,
+		m.Received.Format(time.RFC1123Z),
+	)
+}
@@ -0,0 +1,241 @@
+package helo
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// Metrics counts connections, sessions, commands and messages
+	// across the servers it is set on, and serves them over http in the
+	// Prometheus text exposition format.
+	Metrics struct {
+		mu                  sync.Mutex
+		connectionsAccepted uint64
+		connectionsActive   int64
+		bytesReceived       uint64
+		sessions            map[string]uint64
+		commands            map[metricsCommand]uint64
+		messageSize         *histogram
+		commandDuration     map[string]*histogram
+	}
+	metricsCommand struct {
+		verb, code string
+	}
+	histogram struct {
+		bounds []float64
+		counts []uint64
+		sum    float64
+		count  uint64
+	}
+)
+
+const (
+	// session outcomes
+	OutcomeQuit         = "quit"
+	OutcomeDisconnected = "disconnected"
+	OutcomeError        = "error"
+	OutcomeScript       = "script"
+	OutcomeKilled       = "killed" // through the registry
+)
+
+var (
+	message_size_buckets     = []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+	command_duration_buckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5}
+
+	// verbs are labels as they are, anything else is "other" to bound
+	// the number of series
+	known_verbs = map[string]bool{
+		CommandHelo: true, CommandMail: true, CommandRcpt: true, CommandData: true,
+		CommandRset: true, CommandSend: true, CommandSoml: true, CommandSaml: true,
+		CommandVrfy: true, CommandExpn: true, CommandHelp: true, CommandNoop: true,
+		CommandQuit: true, CommandTurn: true, CommandEhlo: true, CommandAuth: true,
+		CommandStarttls: true, CommandLhlo: true,
+	}
+)
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		sessions:        make(map[string]uint64),
+		commands:        make(map[metricsCommand]uint64),
+		messageSize:     newHistogram(message_size_buckets),
+		commandDuration: make(map[string]*histogram),
+	}
+}
+
+func (s *SmtpServer) SetMetrics(metrics *Metrics) {
+	s.metrics = metrics
+}
+
+// The recording methods are no-ops on a nil *Metrics so the server
+// can call them unconditionally.
+
+func (m *Metrics) connected() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.connectionsAccepted++
+	m.connectionsActive++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) disconnected(outcome string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.connectionsActive--
+	m.sessions[outcome]++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) received(n int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.bytesReceived += uint64(n)
+	m.mu.Unlock()
+}
+
+func (m *Metrics) message(size int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.messageSize.observe(float64(size))
+	m.mu.Unlock()
+}
+
+// reply counts a reply written to c, timing it from when the command
+// it answers was read.  Continuation lines and the greeting are not
+// counted.
+func (m *Metrics) reply(c *session, data string) {
+
+	if m == nil || c.verb == "" || len(data) < 4 || data[3] != ' ' {
+		return
+	}
+
+	verb := c.verb
+	if !known_verbs[verb] {
+		verb = "other"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.commands[metricsCommand{verb, data[:3]}]++
+
+	h, ok := m.commandDuration[verb]
+	if !ok {
+		h = newHistogram(command_duration_buckets)
+		m.commandDuration[verb] = h
+	}
+	h.observe(time.Since(c.since).Seconds())
+
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	metricsHeader(w, "helo_connections_accepted_total", "counter", "Connections accepted.")
+	fmt.Fprintf(w, "helo_connections_accepted_total %d\n", m.connectionsAccepted)
+
+	metricsHeader(w, "helo_connections_active", "gauge", "Connections currently open.")
+	fmt.Fprintf(w, "helo_connections_active %d\n", m.connectionsActive)
+
+	metricsHeader(w, "helo_sessions_total", "counter", "Sessions ended, by outcome.")
+	outcomes := make([]string, 0, len(m.sessions))
+	for outcome := range m.sessions {
+		outcomes = append(outcomes, outcome)
+	}
+	sort.Strings(outcomes)
+	for _, outcome := range outcomes {
+		fmt.Fprintf(w, "helo_sessions_total{outcome=%q} %d\n", outcome, m.sessions[outcome])
+	}
+
+	metricsHeader(w, "helo_commands_total", "counter", "Replies to commands, by verb and reply code.")
+	commands := make([]metricsCommand, 0, len(m.commands))
+	for c := range m.commands {
+		commands = append(commands, c)
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		if commands[i].verb != commands[j].verb {
+			return commands[i].verb < commands[j].verb
+		}
+		return commands[i].code < commands[j].code
+	})
+	for _, c := range commands {
+		fmt.Fprintf(w, "helo_commands_total{verb=%q,code=%q} %d\n", c.verb, c.code, m.commands[c])
+	}
+
+	metricsHeader(w, "helo_received_bytes_total", "counter", "Bytes read from clients.")
+	fmt.Fprintf(w, "helo_received_bytes_total %d\n", m.bytesReceived)
+
+	metricsHeader(w, "helo_message_size_bytes", "histogram", "Sizes of message data received.")
+	m.messageSize.write(w, "helo_message_size_bytes", "")
+
+	metricsHeader(w, "helo_command_duration_seconds", "histogram", "Time from reading a command to replying, by verb.")
+	verbs := make([]string, 0, len(m.commandDuration))
+	for verb := range m.commandDuration {
+		verbs = append(verbs, verb)
+	}
+	sort.Strings(verbs)
+	for _, verb := range verbs {
+		m.commandDuration[verb].write(w, "helo_command_duration_seconds", fmt.Sprintf("verb=%q", verb))
+	}
+
+}
+
+func metricsHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, labels string) {
+
+	prefix := labels
+	if prefix != "" {
+		prefix += ","
+	}
+
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", name, prefix, bound, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, prefix, h.count)
+
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+
+}
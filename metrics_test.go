@@ -0,0 +1,63 @@
+package helo
+
+import (
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	MetricsTestHost = ":9983"
+)
+
+func TestMetrics(t *testing.T) {
+
+	metrics := NewMetrics()
+
+	s := NewSmtpServer(MetricsTestHost)
+	s.SetMetrics(metrics)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	err := smtp.SendMail(MetricsTestHost, nil, "sender@example.org", []string{"recipient@example.net"}, []byte("This is the email body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		return rec.Body.String()
+	}
+
+	// the session is counted once the server has closed it
+	var body string
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if body = scrape(); strings.Contains(body, `helo_sessions_total{outcome="quit"} 1`) {
+			break
+		}
+	}
+
+	for _, line := range []string{
+		"helo_connections_accepted_total 1\n",
+		"helo_connections_active 0\n",
+		`helo_sessions_total{outcome="quit"} 1` + "\n",
+		`helo_commands_total{verb="EHLO",code="250"} 1` + "\n",
+		`helo_commands_total{verb="DATA",code="354"} 1` + "\n",
+		`helo_commands_total{verb="DATA",code="250"} 1` + "\n",
+		`helo_commands_total{verb="QUIT",code="221"} 1` + "\n",
+		`helo_message_size_bytes_bucket{le="1024"} 1` + "\n",
+		"helo_message_size_bytes_count 1\n",
+		`helo_command_duration_seconds_bucket{verb="MAIL",le="+Inf"} 1` + "\n",
+		`helo_command_duration_seconds_count{verb="RCPT"} 1` + "\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("missing %q in\n%s", line, body)
+		}
+	}
+
+}
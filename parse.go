@@ -0,0 +1,114 @@
+package helo
+
+import (
+	"mime"
+	"net/mail"
+	"strings"
+)
+
+type (
+	// ParsedMessage is the decoded form of a message: headers with
+	// encoded words decoded, the mime tree, the text and html bodies
+	// converted to utf-8 and the attachments.
+	ParsedMessage struct {
+		Header      mail.Header
+		Subject     string
+		Root        *Part
+		Text        string
+		HTML        string
+		Attachments []Attachment
+	}
+	Attachment struct {
+		Filename    string `json:"filename"`
+		ContentType string `json:"content_type"`
+		ContentID   string `json:"content_id,omitempty"`
+		Disposition string `json:"disposition,omitempty"`
+		Size        int    `json:"size"`
+		Part        *Part  `json:"-"`
+	}
+)
+
+var (
+	word_decoder = &mime.WordDecoder{CharsetReader: charsetReader}
+)
+
+// Parse decodes the message.  Parts in charsets Part.Text does not
+// support are kept as is rather than failing the parse.
+func (m *Message) Parse() (*ParsedMessage, error) {
+
+	root, err := m.Parts()
+	if err != nil {
+		return nil, err
+	}
+
+	parsed := &ParsedMessage{
+		Header: make(mail.Header, len(root.Header)),
+		Root:   root,
+	}
+
+	for key, values := range root.Header {
+		for _, value := range values {
+			parsed.Header[key] = append(parsed.Header[key], DecodeHeader(value))
+		}
+	}
+	parsed.Subject = parsed.Header.Get("Subject")
+
+	for _, p := range root.Leaves() {
+
+		if p.IsAttachment() {
+			parsed.Attachments = append(parsed.Attachments, Attachment{
+				Filename:    p.Filename,
+				ContentType: p.ContentType,
+				ContentID:   strings.Trim(p.Header.Get("Content-Id"), "<>"),
+				Disposition: p.Disposition,
+				Size:        len(p.Body),
+				Part:        p,
+			})
+			continue
+		}
+
+		switch p.ContentType {
+		case "text/plain":
+			if len(parsed.Text) == 0 {
+				parsed.Text, _ = p.Text()
+			}
+		case "text/html":
+			if len(parsed.HTML) == 0 {
+				parsed.HTML, _ = p.Text()
+			}
+		}
+
+	}
+
+	return parsed, nil
+
+}
+
+// Attachment returns the first attachment named filename.
+func (pm *ParsedMessage) Attachment(filename string) (Attachment, bool) {
+	for _, a := range pm.Attachments {
+		if a.Filename == filename {
+			return a, true
+		}
+	}
+	return Attachment{}, false
+}
+
+// Text returns the part body converted from its charset to utf-8.
+// Only the charsets ToUTF8 supports are converted: for any other the
+// body is returned unconverted, so possibly not utf-8, along with a
+// CharsetError naming the charset.
+func (p *Part) Text() (string, error) {
+	text, err := ToUTF8(p.Params["charset"], p.Body)
+	return string(text), err
+}
+
+// DecodeHeader decodes rfc 2047 encoded words in a header value,
+// returning the value unchanged if it cannot be decoded.
+func DecodeHeader(value string) string {
+	decoded, err := word_decoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
@@ -0,0 +1,78 @@
+package helo
+
+import (
+	"testing"
+)
+
+const (
+	TestEncodedMessage = "Subject: =?iso-8859-1?q?caf=E9?= =?utf-8?b?4piV?=\r\n" +
+		"From: =?utf-8?q?J=C3=BCrgen?= <j@example.org>\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain; charset=windows-1252\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"=93quoted=94 =80\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/pdf\r\n" +
+		"Content-Disposition: attachment; filename=\"=?utf-8?q?r=C3=A9sum=C3=A9.pdf?=\"\r\n" +
+		"Content-ID: <cv@example.org>\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"JVBERi0xLjQ=\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain; charset=koi8-r\r\n" +
+		"Content-Disposition: attachment; filename*=utf-8''%E2%98%95.txt\r\n" +
+		"\r\n" +
+		"unsupported\r\n" +
+		"--b--\r\n"
+)
+
+func TestParse(t *testing.T) {
+
+	m := &Message{Data: TestEncodedMessage}
+
+	parsed, err := m.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.Subject != "café☕" || m.Subject() != "café☕" {
+		t.Errorf("unexpected subject %q", parsed.Subject)
+	}
+	if from := parsed.Header.Get("From"); from != "Jürgen <j@example.org>" {
+		t.Errorf("unexpected from %q", from)
+	}
+	if parsed.Text != "“quoted” €" {
+		t.Errorf("unexpected text %q", parsed.Text)
+	}
+	if len(parsed.HTML) != 0 {
+		t.Errorf("unexpected html %q", parsed.HTML)
+	}
+
+	if len(parsed.Attachments) != 2 {
+		t.Fatalf("expected 2 attachments, got %+v", parsed.Attachments)
+	}
+
+	pdf, ok := parsed.Attachment("résumé.pdf")
+	if !ok {
+		t.Fatalf("expected résumé.pdf in %+v", parsed.Attachments)
+	}
+	if pdf.ContentType != "application/pdf" || pdf.ContentID != "cv@example.org" || string(pdf.Part.Body) != "%PDF-1.4" {
+		t.Errorf("unexpected attachment %+v", pdf)
+	}
+
+	txt, ok := parsed.Attachment("☕.txt")
+	if !ok {
+		t.Fatalf("expected ☕.txt in %+v", parsed.Attachments)
+	}
+	if text, err := txt.Part.Text(); err != CharsetError("koi8-r") || text != "unsupported" {
+		t.Errorf("expected unconverted text and charset error, got %q %v", text, err)
+	}
+	if err := CharsetError("koi8-r").Error(); err != `unsupported charset "koi8-r", only utf-8, us-ascii, iso-8859-1, iso-8859-15 and windows-1252 are decoded` {
+		t.Errorf("unexpected error %q", err)
+	}
+
+}
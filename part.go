@@ -0,0 +1,145 @@
+package helo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+)
+
+type (
+	// Part is a node in the mime tree of a message.  Multipart nodes
+	// hold their children in Parts, leaves hold their content in Body
+	// with the transfer encoding removed.
+	Part struct {
+		Header      textproto.MIMEHeader
+		ContentType string
+		Params      map[string]string
+		Disposition string
+		Filename    string
+		Body        []byte
+		Parts       []*Part
+	}
+)
+
+const (
+	max_part_depth = 32
+)
+
+// Parts parses the message data into its mime tree.
+func (m *Message) Parts() (*Part, error) {
+	return ReadPart(strings.NewReader(m.Data))
+}
+
+// ReadPart parses a mime entity, headers and body.
+func ReadPart(r io.Reader) (*Part, error) {
+
+	br := bufio.NewReader(r)
+
+	header, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return readPart(header, br, 0)
+
+}
+
+func readPart(header textproto.MIMEHeader, r io.Reader, depth int) (*Part, error) {
+
+	var err error
+
+	p := &Part{Header: header}
+
+	p.ContentType, p.Params, err = mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		p.ContentType, p.Params = "text/plain", map[string]string{"charset": "us-ascii"}
+	}
+
+	if disposition, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		p.Disposition = disposition
+		p.Filename = DecodeHeader(params["filename"])
+	}
+	if len(p.Filename) == 0 {
+		p.Filename = DecodeHeader(p.Params["name"])
+	}
+
+	if strings.HasPrefix(p.ContentType, "multipart/") && len(p.Params["boundary"]) > 0 && depth < max_part_depth {
+		mr := multipart.NewReader(r, p.Params["boundary"])
+		for {
+			np, err := mr.NextRawPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			child, err := readPart(np.Header, np, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			p.Parts = append(p.Parts, child)
+		}
+		return p, nil
+	}
+
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	p.Body, err = decodeTransfer(header.Get("Content-Transfer-Encoding"), body)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+
+}
+
+// Walk calls fn for p and each of its descendants, depth first.
+func (p *Part) Walk(fn func(*Part)) {
+	fn(p)
+	for _, child := range p.Parts {
+		child.Walk(fn)
+	}
+}
+
+// Leaves returns every non multipart part in order.
+func (p *Part) Leaves() []*Part {
+	var leaves []*Part
+	p.Walk(func(p *Part) {
+		if len(p.Parts) == 0 && !strings.HasPrefix(p.ContentType, "multipart/") {
+			leaves = append(leaves, p)
+		}
+	})
+	return leaves
+}
+
+func (p *Part) IsAttachment() bool {
+	return p.Disposition == "attachment" || (len(p.Filename) > 0 && p.Disposition != "inline")
+}
+
+func decodeTransfer(encoding string, body []byte) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		// line breaks and other whitespace are allowed in the encoding
+		clean := bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, body)
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(clean)))
+		n, err := base64.StdEncoding.Decode(decoded, clean)
+		return decoded[:n], err
+	case "quoted-printable":
+		return io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+	}
+	return body, nil
+}
@@ -0,0 +1,490 @@
+package helo
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// Queue is a durable outbound queue in front of another backend,
+	// typically a synchronous RelayBackend.  Accepted messages are split
+	// per destination domain and written to dir, one .eml holding the
+	// data and one .json holding the QueueEntry, so they survive
+	// restarts.  Entries are retried on an exponential schedule from
+	// RetryInterval up to MaxRetryInterval with at most Concurrency
+	// attempts in flight per destination.  A permanent (5xx) failure,
+	// or a temporary one once an entry is older than MaxAge, removes it
+	// and queues a bounce to the sender.
+	//
+	// Fields must be set before Start.
+	Queue struct {
+		RetryInterval    time.Duration
+		MaxRetryInterval time.Duration
+		MaxAge           time.Duration
+		Concurrency      int
+		PollInterval     time.Duration
+		Logger           *log.Logger
+
+		dir  string
+		next Backend
+		host string
+
+		mu       sync.Mutex
+		entries  map[string]*QueueEntry
+		inflight map[string]int
+		running  bool
+		stop     chan struct{}
+		wg       sync.WaitGroup
+	}
+	QueueEntry struct {
+		ID          string    `json:"id"`
+		Destination string    `json:"destination"`
+		Envelope    Envelope  `json:"envelope"`
+		Created     time.Time `json:"created"`
+		NextAttempt time.Time `json:"next_attempt"`
+		Attempts    int       `json:"attempts"`
+		LastError   string    `json:"last_error,omitempty"`
+
+		busy bool
+	}
+)
+
+const (
+	DefaultQueueRetryInterval    = time.Minute
+	DefaultQueueMaxRetryInterval = time.Hour
+	DefaultQueueMaxAge           = 5 * 24 * time.Hour
+	DefaultQueueConcurrency      = 2
+	DefaultQueuePollInterval     = time.Second
+)
+
+var (
+	QueueNotRunningError = errors.New("queue not running")
+)
+
+func NewQueue(dir string, next Backend) (*Queue, error) {
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Queue{
+		RetryInterval:    DefaultQueueRetryInterval,
+		MaxRetryInterval: DefaultQueueMaxRetryInterval,
+		MaxAge:           DefaultQueueMaxAge,
+		Concurrency:      DefaultQueueConcurrency,
+		PollInterval:     DefaultQueuePollInterval,
+		dir:              dir,
+		next:             next,
+		host:             host,
+		entries:          make(map[string]*QueueEntry),
+		inflight:         make(map[string]int),
+	}, nil
+
+}
+
+// Start loads the entries left in dir by a previous run and starts
+// delivering.
+func (q *Queue) Start() error {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.running {
+		return AlreadyRunningError
+	}
+
+	if err := q.load(); err != nil {
+		return err
+	}
+
+	q.running = true
+	q.stop = make(chan struct{})
+
+	q.wg.Add(1)
+	go q.run()
+
+	return nil
+
+}
+
+// Stop stops scheduling and waits for attempts in flight.  Entries
+// stay on disk for the next Start.
+func (q *Queue) Stop() {
+
+	q.mu.Lock()
+	if !q.running {
+		q.mu.Unlock()
+		return
+	}
+	q.running = false
+	close(q.stop)
+	q.mu.Unlock()
+
+	q.wg.Wait()
+
+}
+
+// Deliver queues a copy of m per destination domain.  The client is
+// answered as soon as the entries are on disk.
+func (q *Queue) Deliver(m *Message) error {
+
+	q.mu.Lock()
+	running := q.running
+	q.mu.Unlock()
+
+	if !running {
+		return QueueNotRunningError
+	}
+
+	return q.enqueue(m)
+
+}
+
+// Entries returns a snapshot of the queue ordered by creation.
+func (q *Queue) Entries() []QueueEntry {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entries := make([]QueueEntry, 0, len(q.entries))
+	for _, e := range q.entries {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Created.Before(entries[j].Created)
+	})
+
+	return entries
+
+}
+
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+func (q *Queue) enqueue(m *Message) error {
+
+	now := time.Now()
+
+	// one entry per destination domain, in recipient order
+	var (
+		domains []string
+		rcpts   = make(map[string][]string)
+	)
+	for _, to := range m.To {
+		d := destination(to)
+		if _, ok := rcpts[d]; !ok {
+			domains = append(domains, d)
+		}
+		rcpts[d] = append(rcpts[d], to)
+	}
+
+	for _, d := range domains {
+
+		envelope := m.Envelope()
+		envelope.ID = ""
+		envelope.To = rcpts[d]
+
+		e := &QueueEntry{
+			ID:          newQueueID(),
+			Destination: d,
+			Envelope:    envelope,
+			Created:     now,
+			NextAttempt: now,
+		}
+
+		if err := writeFileAtomic(q.path(e.ID, ".eml"), []byte(m.Data)); err != nil {
+			return err
+		}
+		// the entry only exists once its metadata is written
+		if err := q.save(e); err != nil {
+			os.Remove(q.path(e.ID, ".eml"))
+			return err
+		}
+
+		q.mu.Lock()
+		q.entries[e.ID] = e
+		q.mu.Unlock()
+
+	}
+
+	return nil
+
+}
+
+func (q *Queue) run() {
+
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(q.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		q.schedule()
+		select {
+		case <-ticker.C:
+		case <-q.stop:
+			return
+		}
+	}
+
+}
+
+// schedule starts an attempt for every due entry its destination has
+// capacity for.
+func (q *Queue) schedule() {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.running {
+		return
+	}
+
+	now := time.Now()
+
+	due := make([]*QueueEntry, 0)
+	for _, e := range q.entries {
+		if !e.busy && !e.NextAttempt.After(now) {
+			due = append(due, e)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].NextAttempt.Before(due[j].NextAttempt)
+	})
+
+	for _, e := range due {
+		if q.inflight[e.Destination] >= q.Concurrency {
+			continue
+		}
+		q.inflight[e.Destination]++
+		e.busy = true
+		q.wg.Add(1)
+		go q.attempt(e)
+	}
+
+}
+
+func (q *Queue) attempt(e *QueueEntry) {
+
+	defer q.wg.Done()
+
+	data, err := os.ReadFile(q.path(e.ID, ".eml"))
+	if err == nil {
+		err = q.next.Deliver(&Message{
+			From:       e.Envelope.From,
+			To:         e.Envelope.To,
+			Data:       string(data),
+			Helo:       e.Envelope.Helo,
+			RemoteAddr: e.Envelope.RemoteAddr,
+			Received:   e.Envelope.Received,
+		})
+	}
+
+	// the entry stays busy until it is either removed or rescheduled,
+	// so schedule never starts a second attempt in between
+	q.mu.Lock()
+	q.inflight[e.Destination]--
+	e.Attempts++
+	done := err == nil || replyFor(err)/100 == 5 || time.Since(e.Created) >= q.MaxAge
+	if done {
+		delete(q.entries, e.ID)
+	} else {
+		e.LastError = err.Error()
+		e.NextAttempt = time.Now().Add(q.backoff(e.Attempts))
+		e.busy = false
+	}
+	attempts, next := e.Attempts, e.NextAttempt
+	q.mu.Unlock()
+
+	switch {
+	case err == nil:
+		q.remove(e)
+
+	case done:
+		q.logf("queue: giving up on %s to %s after %d attempts: %s", e.ID, e.Destination, attempts, err)
+		q.bounce(e, string(data), err)
+		q.remove(e)
+
+	default:
+		q.logf("queue: %s to %s failed, attempt %d, retrying at %s: %s", e.ID, e.Destination, attempts, next.Format(time.RFC3339), err)
+		if err := q.save(e); err != nil {
+			q.logf("queue: %s", err)
+		}
+	}
+
+}
+
+func (q *Queue) backoff(attempts int) time.Duration {
+	d := q.RetryInterval
+	for i := 1; i < attempts && d < q.MaxRetryInterval; i++ {
+		d *= 2
+	}
+	if d > q.MaxRetryInterval {
+		d = q.MaxRetryInterval
+	}
+	return d
+}
+
+// bounce queues a delivery status notification to the sender.  Bounces
+// have a null sender and are never bounced themselves.
+func (q *Queue) bounce(e *QueueEntry, data string, reason error) {
+
+	if len(e.Envelope.From) == 0 {
+		return
+	}
+
+	if err := q.enqueue(&Message{
+		To:       []string{e.Envelope.From},
+		Data:     q.bounceData(e, data, reason),
+		Helo:     q.host,
+		Received: time.Now(),
+	}); err != nil {
+		q.logf("queue: bounce for %s: %s", e.ID, err)
+	}
+
+}
+
+func (q *Queue) bounceData(e *QueueEntry, data string, reason error) string {
+
+	boundary := newQueueID()
+	status := "5.0.0"
+	if replyFor(reason)/100 == 4 {
+		status = "4.4.7" // delivery time expired
+	}
+
+	// upstream replies already carry their code
+	var re *ReplyError
+	if errors.As(reason, &re) {
+		reason = re.Err
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", q.host)
+	fmt.Fprintf(&b, "To: <%s>\r\n", e.Envelope.From)
+	fmt.Fprintf(&b, "Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=delivery-status; boundary=%q\r\n\r\n", boundary)
+
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: text/plain; charset=us-ascii\r\n\r\n", boundary)
+	fmt.Fprintf(&b, "Your message could not be delivered to the following recipients\r\nafter %d attempts:\r\n\r\n", e.Attempts)
+	for _, to := range e.Envelope.To {
+		fmt.Fprintf(&b, "  <%s>: %s\r\n", to, reason)
+	}
+
+	fmt.Fprintf(&b, "\r\n--%s\r\nContent-Type: message/delivery-status\r\n\r\n", boundary)
+	fmt.Fprintf(&b, "Reporting-MTA: dns; %s\r\nArrival-Date: %s\r\n", q.host, e.Created.Format(time.RFC1123Z))
+	for _, to := range e.Envelope.To {
+		fmt.Fprintf(&b, "\r\nFinal-Recipient: rfc822; %s\r\nAction: failed\r\nStatus: %s\r\nDiagnostic-Code: smtp; %s\r\n", to, status, strings.Replace(reason.Error(), "\n", " ", -1))
+	}
+
+	fmt.Fprintf(&b, "\r\n--%s\r\nContent-Type: text/rfc822-headers\r\n\r\n", boundary)
+	if i := strings.Index(data, "\r\n\r\n"); i > -1 {
+		b.WriteString(data[:i+2])
+	} else {
+		b.WriteString(data)
+	}
+
+	fmt.Fprintf(&b, "\r\n--%s--\r\n", boundary)
+
+	return b.String()
+
+}
+
+func (q *Queue) load() error {
+
+	metas, err := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, meta := range metas {
+		data, err := os.ReadFile(meta)
+		if err != nil {
+			return err
+		}
+		e := &QueueEntry{}
+		if err := json.Unmarshal(data, e); err != nil {
+			q.logf("queue: skipping %s: %s", meta, err)
+			continue
+		}
+		q.entries[e.ID] = e
+	}
+
+	// data without metadata is left over from an interrupted enqueue
+	emls, err := filepath.Glob(filepath.Join(q.dir, "*.eml"))
+	if err != nil {
+		return err
+	}
+	for _, eml := range emls {
+		if _, ok := q.entries[strings.TrimSuffix(filepath.Base(eml), ".eml")]; !ok {
+			os.Remove(eml)
+		}
+	}
+
+	return nil
+
+}
+
+func (q *Queue) save(e *QueueEntry) error {
+	q.mu.Lock()
+	data, err := json.MarshalIndent(e, "", "  ")
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(q.path(e.ID, ".json"), append(data, '\n'))
+}
+
+// remove deletes the files of an entry already taken out of entries.
+func (q *Queue) remove(e *QueueEntry) {
+
+	// metadata first so a crash in between leaves an orphan, not an entry
+	os.Remove(q.path(e.ID, ".json"))
+	os.Remove(q.path(e.ID, ".eml"))
+
+}
+
+func (q *Queue) path(id, ext string) string {
+	return filepath.Join(q.dir, id+ext)
+}
+
+func (q *Queue) logf(format string, args ...interface{}) {
+	if q.Logger != nil {
+		q.Logger.Printf(format, args...)
+	}
+}
+
+func newQueueID() string {
+	id := make([]byte, 6)
+	rand.Read(id)
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(id)
+}
+
+// destination is the lowercased domain of a recipient.
+func destination(rcpt string) string {
+	if i := strings.LastIndexByte(rcpt, '@'); i > -1 {
+		return strings.ToLower(rcpt[i+1:])
+	}
+	return ""
+}
@@ -0,0 +1,170 @@
+package helo
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueue(t *testing.T) {
+
+	var (
+		mu        sync.Mutex
+		failures  = 1
+		delivered = make(chan *Message, 10)
+	)
+
+	next := BackendFunc(func(m *Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			return errors.New("connection refused")
+		}
+		if m.To[0] == "unknown@example.com" {
+			return &ReplyError{ReplyRequestedActionNotTakenMailboxUnavailable, errors.New("550 no such user")}
+		}
+		delivered <- m
+		return nil
+	})
+
+	dir := t.TempDir()
+
+	q, err := NewQueue(dir, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.RetryInterval = 20 * time.Millisecond
+	q.PollInterval = 5 * time.Millisecond
+
+	m := testMessage()
+	m.To = []string{"a@example.net", "b@EXAMPLE.net", "c@example.org"}
+
+	// queued while stopped are refused, entries on disk survive a restart
+	if err := q.Deliver(m); err != QueueNotRunningError {
+		t.Fatalf("expected queue not running, got %v", err)
+	}
+	if err := q.enqueue(m); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err = NewQueue(dir, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.RetryInterval = 20 * time.Millisecond
+	q.PollInterval = 5 * time.Millisecond
+
+	if err := q.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Stop()
+
+	if q.Len() != 2 {
+		t.Fatalf("expected an entry per destination, got %+v", q.Entries())
+	}
+
+	got := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-delivered:
+			got[strings.Join(m.To, ",")] = true
+		case <-time.After(time.Second):
+			t.Fatalf("timed out, queue %+v", q.Entries())
+		}
+	}
+	if !got["a@example.net,b@EXAMPLE.net"] || !got["c@example.org"] {
+		t.Errorf("unexpected deliveries %v", got)
+	}
+
+	// a permanent failure bounces to the sender
+	m.To = []string{"unknown@example.com"}
+	if err := q.Deliver(m); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case bounce := <-delivered:
+		if bounce.From != "" || bounce.To[0] != "sender@example.org" {
+			t.Errorf("unexpected bounce envelope %+v", bounce)
+		}
+		if !strings.Contains(bounce.Data, "Final-Recipient: rfc822; unknown@example.com") || !strings.Contains(bounce.Data, "Diagnostic-Code: smtp; 550 no such user") {
+			t.Errorf("unexpected bounce %s", bounce.Data)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for bounce, queue %+v", q.Entries())
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if q.Len() != 0 {
+		t.Errorf("expected empty queue, got %+v", q.Entries())
+	}
+
+}
+
+func TestQueueBouncesOnce(t *testing.T) {
+
+	const messages = 50
+
+	var (
+		mu      sync.Mutex
+		bounces int
+	)
+
+	next := BackendFunc(func(m *Message) error {
+		if m.From != "" {
+			return &ReplyError{ReplyRequestedActionNotTakenMailboxUnavailable, errors.New("550 no such user")}
+		}
+		mu.Lock()
+		bounces++
+		mu.Unlock()
+		return nil
+	})
+
+	q, err := NewQueue(t.TempDir(), next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.PollInterval = time.Millisecond
+	q.Concurrency = messages
+	// a slow log widens the window between an attempt and its outcome
+	q.Logger = log.New(slowWriter(2*time.Millisecond), "", 0)
+
+	if err := q.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Stop()
+
+	for i := 0; i < messages; i++ {
+		if err := q.Deliver(testMessage()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return bounces
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); count() < messages && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// give a second attempt on any entry the time to show up
+	time.Sleep(50 * time.Millisecond)
+
+	if n := count(); n != messages || q.Len() != 0 {
+		t.Errorf("expected %d bounces, got %d, queue %+v", messages, n, q.Entries())
+	}
+
+}
+
+type slowWriter time.Duration
+
+func (w slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(time.Duration(w))
+	return len(p), nil
+}
@@ -4,14 +4,18 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
-	"regexp"
+	"net"
 	"strings"
+	"sync"
+	"time"
 )
 
 type (
 	Reader struct {
 		*bufio.Reader
 		s *SmtpServer
+		c *session
+		t *Transcript
 	}
 )
 
@@ -46,63 +50,309 @@ const (
 	CommandSize       = "SIZE"
 	CommandStarttls   = "STARTTLS"
 	CommandSmtputf8   = "SMTPUTF8"
+
+	// lmtp
+	CommandLhlo = "LHLO"
 )
 
 var (
-	command_regexp  = regexp.MustCompile("^([A-Za-z0-9]+) ?(.*)\r\n$")
-	to_email_regexp = regexp.MustCompile("^[Tt][Oo]:<([^>]+)>$")
-	// SIZE unused in this context
-	from_email_regexp = regexp.MustCompile(`^[Ff][Rr][Oo][Mm]:<([^>]+)>(?: [Ss][Ii][Zz][Ee]=\d+)?$`)
-
 	BadSyntaxError   = errors.New("bad syntax error")
 	MessageSizeError = errors.New("max message size exceeded")
+
+	end_of_data = []byte("\r\n.\r\n")
+
+	// readers and data buffers outlive their sessions
+	reader_pool = sync.Pool{New: func() interface{} { return bufio.NewReaderSize(nil, reader_size) }}
+	data_pool   = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+)
+
+const (
+	// the longest command line read, RFC 5321 allows 512
+	reader_size = 4 << 10
+	// data buffers grown past this are left to the gc
+	max_pooled_data = 1 << 20
+
+	// what credentials are logged and recorded as
+	redacted = "<redacted>"
 )
 
+func (s *SmtpServer) newReader(conn net.Conn, c *session, t *Transcript) *Reader {
+	br := reader_pool.Get().(*bufio.Reader)
+	br.Reset(conn)
+	return &Reader{br, s, c, t}
+}
+
+// release returns the buffer of r to the pool, after which r is not
+// to be used.
+func (r *Reader) release() {
+	r.Reader.Reset(nil)
+	reader_pool.Put(r.Reader)
+	r.Reader = nil
+}
+
 func (r *Reader) ReadCommand() (string, string, error) {
 
-	data := make([]byte, 1<<10)
-	n, err := r.Read(data)
+	data, err := r.ReadSlice('\n')
+	n := len(data)
+	for err == bufio.ErrBufferFull {
+		// too long for a command, the rest is skipped
+		data, err = r.ReadSlice('\n')
+		n += len(data)
+		data = nil
+	}
 	if err != nil {
 		return "", "", err
 	}
-	data = data[:n]
 
-	r.s.logf("<<< %q", data)
+	r.c.since = time.Now()
+
+	// the one allocation, which verb and arg are sliced from
+	line := string(data)
+
+	verb, arg, ok := parseCommand(line)
+	if ok {
+		r.c.setVerb(strings.ToUpper(verb))
+	} else {
+		r.c.setVerb("other")
+	}
 
-	if matches := command_regexp.FindSubmatch(data); len(matches) == 3 {
-		return strings.ToUpper(string(matches[1])), string(matches[2]), nil
+	// credentials are kept out of the logs and transcripts
+	logged := line
+	if ok && strings.EqualFold(verb, CommandAuth) {
+		logged = redactAuth(line, arg)
 	}
-	return "", "", BadSyntaxError
+
+	r.c.traffic(DirectionClient, logged)
+	r.t.record(DirectionClient, logged)
+	r.s.metrics.received(n)
+	r.c.read(n)
+
+	if !ok {
+		return "", "", BadSyntaxError
+	}
+	return r.c.verb, arg, nil
 
 }
 
 func (r *Reader) ReadData() (string, error) {
 
 	var (
-		data  []byte
-		total int
+		total      int
+		line_start = true
+		stuffed    []int // offsets of the dots stuffed by the client
+		started    = time.Now()
 	)
 
+	buf := data_pool.Get().(*bytes.Buffer)
+	defer func() {
+		if buf.Cap() <= max_pooled_data {
+			buf.Reset()
+			data_pool.Put(buf)
+		}
+	}()
+
 	for {
-		d := make([]byte, 24<<10)
-		n, err := r.Read(d)
-		if err != nil {
+		line, err := r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
 			return "", err
 		}
-		total += n
+		total += len(line)
+		r.s.metrics.received(len(line))
+		r.c.read(len(line))
 		if total > MaxMessageSize {
 			return "", MessageSizeError
 		}
-		data = append(data, d[:n]...)
-		if bytes.HasSuffix(data, []byte("\r\n.\r\n")) {
+		// the terminating dot is only ever read at the start of a line,
+		// the first one for an empty message, and any other leading dot
+		// was stuffed by the client (RFC 5321 4.5.2)
+		if line_start && bytes.Equal(line, end_of_data[2:]) && (buf.Len() == 0 || bytes.HasSuffix(buf.Bytes(), end_of_data[:2])) {
+			buf.Write(line)
 			break
 		}
+		if line_start && len(line) > 0 && line[0] == '.' {
+			stuffed = append(stuffed, buf.Len())
+		}
+		buf.Write(line)
+		line_start = err == nil
+	}
+
+	// the end of data reply is timed from here
+	r.c.since = time.Now()
+
+	r.c.stats.DataBytes += int64(total)
+	r.c.stats.DataDuration += r.c.since.Sub(started)
+
+	// logged and recorded as sent, stuffed and terminated
+	raw := buf.String()
+	r.c.traffic(DirectionClient, raw)
+	r.t.record(DirectionClient, raw)
+
+	data := strings.TrimSuffix(raw[:len(raw)-len(end_of_data[2:])], "\r\n")
+
+	return unstuff(data, stuffed), nil
+
+}
+
+// unstuff removes the dots at offsets from data.
+func unstuff(data string, offsets []int) string {
+
+	if len(offsets) == 0 {
+		return data
+	}
+
+	var b strings.Builder
+	b.Grow(len(data) - len(offsets))
+
+	last := 0
+	for _, i := range offsets {
+		b.WriteString(data[last:i])
+		last = i + 1
+	}
+	b.WriteString(data[last:])
+
+	return b.String()
+
+}
+
+// ReadLine reads a single line that is not a command, such as a
+// response to an AUTH challenge, without its line ending.
+func (r *Reader) ReadLine() (string, error) {
+	return r.readLine(false)
+}
+
+// readSecret reads a line like ReadLine but logs and records it
+// redacted, for AUTH responses.
+func (r *Reader) readSecret() (string, error) {
+	return r.readLine(true)
+}
+
+func (r *Reader) readLine(secret bool) (string, error) {
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	logged := line
+	if secret {
+		logged = redacted + "\r\n"
+	}
+
+	r.c.traffic(DirectionClient, logged)
+	r.t.record(DirectionClient, logged)
+	r.s.metrics.received(len(line))
+	r.c.read(len(line))
+
+	return strings.TrimRight(line, "\r\n"), nil
+
+}
+
+// redactAuth replaces what follows the mechanism of an AUTH command
+// line, the initial response.
+func redactAuth(line, arg string) string {
+	mechanism, initial, _ := strings.Cut(arg, " ")
+	if initial == "" {
+		return line
+	}
+	return line[:len(line)-len(arg)-2] + mechanism + " " + redacted + "\r\n"
+}
+
+// isRedacted reports whether client data was recorded redacted, an
+// AUTH response or an AUTH command with an initial response.
+func isRedacted(data string) bool {
+	if data == redacted+"\r\n" {
+		return true
+	}
+	verb, arg, ok := parseCommand(data)
+	return ok && strings.EqualFold(verb, CommandAuth) && strings.HasSuffix(arg, " "+redacted)
+}
+
+// parseCommand splits a command line into its verb, the letters and
+// digits it starts with, and the argument after an optional space.
+func parseCommand(line string) (string, string, bool) {
+
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", "", false
+	}
+	line = line[:len(line)-2]
+
+	i := 0
+	for i < len(line) && isAlphanumeric(line[i]) {
+		i++
+	}
+	if i == 0 {
+		return "", "", false
+	}
+
+	verb, arg := line[:i], line[i:]
+	if strings.HasPrefix(arg, " ") {
+		arg = arg[1:]
+	}
+	if strings.IndexByte(arg, '\n') >= 0 {
+		return "", "", false
+	}
+
+	return verb, arg, true
+
+}
+
+// parseFrom returns the reverse-path of a MAIL argument, FROM:<path>
+// with any esmtp parameters, which are unused in this context.  The
+// path is empty for the null reverse-path of bounces, FROM:<>.
+func parseFrom(arg string) (string, bool) {
+
+	path, rest, ok := parsePath(arg, "FROM:<")
+	if !ok {
+		return "", false
+	}
+
+	// SIZE, BODY, SMTPUTF8 etc
+	for rest != "" {
+		if rest[0] != ' ' {
+			return "", false
+		}
+		i := 1
+		for i < len(rest) && isParamChar(rest[i]) {
+			i++
+		}
+		if i == 1 {
+			return "", false
+		}
+		rest = rest[i:]
+	}
+
+	return path, true
+
+}
+
+// parseTo returns the forward-path of a RCPT argument, TO:<path>.
+func parseTo(arg string) (string, bool) {
+	path, rest, ok := parsePath(arg, "TO:<")
+	return path, ok && path != "" && rest == ""
+}
+
+// parsePath returns the path between prefix, matched without
+// case, and the next '>', along with what follows.
+func parsePath(arg, prefix string) (string, string, bool) {
+
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", "", false
 	}
+	arg = arg[len(prefix):]
 
-	r.s.logf("<<< %q", data)
+	i := strings.IndexByte(arg, '>')
+	if i < 0 {
+		return "", "", false
+	}
 
-	dataString := string(data)
+	return arg[:i], arg[i+1:], true
 
-	return strings.TrimSuffix(dataString, "\r\n.\r\n"), nil
+}
+
+func isAlphanumeric(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9'
+}
 
+func isParamChar(b byte) bool {
+	return isAlphanumeric(b) || strings.IndexByte("=_.+-", b) >= 0
 }
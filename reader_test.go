@@ -0,0 +1,144 @@
+package helo
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var (
+	// the expressions the parsers replaced, which they must agree with,
+	// but for the null reverse-path
+	command_regexp    = regexp.MustCompile("^([A-Za-z0-9]+) ?(.*)\r\n$")
+	to_email_regexp   = regexp.MustCompile("^[Tt][Oo]:<([^>]+)>$")
+	from_email_regexp = regexp.MustCompile(`^[Ff][Rr][Oo][Mm]:<([^>]*)>(?: [A-Za-z0-9=_.+-]+)*$`)
+)
+
+func TestParseCommand(t *testing.T) {
+
+	for _, line := range []string{
+		"EHLO localhost\r\n",
+		"ehlo localhost\r\n",
+		"QUIT\r\n",
+		"MAIL FROM:<sender@example.org> SIZE=100\r\n",
+		"MAIL:FROM\r\n",
+		"NOOP  two spaces\r\n",
+		"NOOP \r\n",
+		"NOOP\tx\r\n",
+		"NOOP x\r\r\n",
+		"8BITMIME\r\n",
+		"QUIT\n",
+		"QUIT",
+		"\r\n",
+		" QUIT\r\n",
+		"-\r\n",
+		"HELO a\nb\r\n",
+	} {
+		verb, arg, ok := parseCommand(line)
+		matches := command_regexp.FindStringSubmatch(line)
+		if ok != (len(matches) == 3) || ok && (verb != matches[1] || arg != matches[2]) {
+			t.Errorf("parseCommand(%q) = %q, %q, %t, expected %q", line, verb, arg, ok, matches)
+		}
+	}
+
+}
+
+func TestParsePaths(t *testing.T) {
+
+	for _, arg := range []string{
+		"FROM:<sender@example.org>",
+		"from:<sender@example.org>",
+		"FROM:<sender@example.org> SIZE=100 BODY=8BITMIME",
+		"FROM:<sender@example.org>  SIZE=100",
+		"FROM:<sender@example.org> SIZE=100 ",
+		"FROM:<sender@example.org> SIZE=1,0",
+		"FROM:<sender@example.org>x",
+		"FROM:<>",
+		"FROM:<> SIZE=100",
+		"FROM: <sender@example.org>",
+		"FROM:<a<b@example.org>",
+		"FROM:<sender@example.org",
+		"TO:<recipient@example.net>",
+		"to:<recipient@example.net>",
+		"TO:<recipient@example.net> NOTIFY=NEVER",
+		"TO:<recipient@example.net>>",
+		"TO:<>",
+		"TO:",
+		"",
+	} {
+		from, ok := parseFrom(arg)
+		matches := from_email_regexp.FindStringSubmatch(arg)
+		if ok != (len(matches) == 2) || ok && from != matches[1] {
+			t.Errorf("parseFrom(%q) = %q, %t, expected %q", arg, from, ok, matches)
+		}
+
+		to, ok := parseTo(arg)
+		matches = to_email_regexp.FindStringSubmatch(arg)
+		if ok != (len(matches) == 2) || ok && to != matches[1] {
+			t.Errorf("parseTo(%q) = %q, %t, expected %q", arg, to, ok, matches)
+		}
+	}
+
+}
+
+func TestIsRedacted(t *testing.T) {
+
+	for data, expected := range map[string]bool{
+		"<redacted>\r\n":               true,
+		"AUTH PLAIN <redacted>\r\n":    true,
+		"auth login <redacted>\r\n":    true,
+		"AUTH PLAIN\r\n":               false,
+		"NOOP <redacted>\r\n":          false,
+		"Subject: <redacted>\r\n.\r\n": false,
+	} {
+		if got := isRedacted(data); got != expected {
+			t.Errorf("isRedacted(%q) = %t, expected %t", data, got, expected)
+		}
+	}
+
+}
+
+func TestReadData(t *testing.T) {
+
+	server := NewSmtpServer("")
+	server.SetLogger(nil)
+
+	for raw, expected := range map[string]string{
+		".\r\n":                        "",
+		"\r\n.\r\n":                    "",
+		"body\r\n.\r\n":                "body",
+		"..\r\n.\r\n":                  ".",
+		"..leading\r\n...two\r\n.\r\n": ".leading\r\n..two",
+		"a\r\n..\r\n.\r\nb\r\n.\r\n":   "a\r\n.",
+		"not.\r\n. space\r\n.\r\n":     "not.\r\n space",
+	} {
+		conn := &benchConn{line: []byte(raw)}
+		transcript := &Transcript{}
+		r := server.newReader(conn, server.newSession(conn), transcript)
+
+		data, err := r.ReadData()
+		if err != nil || data != expected {
+			t.Errorf("readData() of %q = %q, %v, expected %q", raw, data, err, expected)
+		}
+
+		// recorded as sent up to the terminator
+		entries := transcript.Entries()
+		if len(entries) != 1 || !strings.HasPrefix(raw, entries[0].Data) || !strings.HasSuffix(entries[0].Data, ".\r\n") {
+			t.Errorf("unexpected transcript of %q: %+v", raw, entries)
+		}
+	}
+
+}
+
+func TestParseAllocs(t *testing.T) {
+
+	allocs := testing.AllocsPerRun(100, func() {
+		parseCommand("MAIL FROM:<sender@example.org> SIZE=100\r\n")
+		parseFrom("FROM:<sender@example.org> SIZE=100")
+		parseTo("TO:<recipient@example.net>")
+	})
+	if allocs != 0 {
+		t.Errorf("expected no allocations, got %.0f", allocs)
+	}
+
+}
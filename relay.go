@@ -0,0 +1,180 @@
+package helo
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"sync"
+)
+
+type (
+	// RelayBackend forwards each message to an upstream smtp server,
+	// adding a Received line.  Messages are relayed within DATA so the
+	// upstream reply becomes the client reply, or with Async set from
+	// a bounded queue once accepted, only logging failures.
+	//
+	// Fields must be set before the first Deliver.
+	RelayBackend struct {
+		Addr        string
+		Helo        string
+		StartTLS    bool
+		TLSConfig   *tls.Config
+		Auth        smtp.Auth
+		Async       bool
+		QueueSize   int
+		Concurrency int
+		Logger      *log.Logger
+
+		host  string
+		once  sync.Once
+		queue chan *Message
+		wg    sync.WaitGroup
+	}
+)
+
+const (
+	DefaultRelayQueueSize   = 1000
+	DefaultRelayConcurrency = 4
+)
+
+var (
+	RelayQueueFullError  = errors.New("relay queue full")
+	StartTLSMissingError = errors.New("upstream does not support STARTTLS")
+)
+
+func NewRelayBackend(addr string) *RelayBackend {
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+
+	return &RelayBackend{
+		Addr:        addr,
+		Helo:        host,
+		QueueSize:   DefaultRelayQueueSize,
+		Concurrency: DefaultRelayConcurrency,
+		host:        host,
+	}
+
+}
+
+func (b *RelayBackend) start() {
+	b.queue = make(chan *Message, b.QueueSize)
+	for i := 0; i < b.Concurrency; i++ {
+		b.wg.Add(1)
+		go b.work()
+	}
+}
+
+func (b *RelayBackend) Deliver(m *Message) error {
+
+	if !b.Async {
+		return b.Send(m)
+	}
+
+	b.once.Do(b.start)
+
+	select {
+	case b.queue <- m:
+		return nil
+	default:
+		return &ReplyError{ReplyRequestedActionAbortedInProcessing, RelayQueueFullError}
+	}
+
+}
+
+// Close waits for queued messages to be relayed.  Deliver must not be
+// called after Close.
+func (b *RelayBackend) Close() {
+	if b.Async {
+		b.once.Do(b.start)
+		close(b.queue)
+		b.wg.Wait()
+	}
+}
+
+func (b *RelayBackend) work() {
+	defer b.wg.Done()
+	for m := range b.queue {
+		if err := b.Send(m); err != nil && b.Logger != nil {
+			b.Logger.Printf("relay to %s: %s", b.Addr, err)
+		}
+	}
+}
+
+// Send relays m upstream in a single session.  Replies from the
+// upstream server are returned as a *ReplyError carrying their code.
+func (b *RelayBackend) Send(m *Message) error {
+	return upstreamReply(b.send(m))
+}
+
+func (b *RelayBackend) send(m *Message) error {
+
+	c, err := smtp.Dial(b.Addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Hello(b.Helo); err != nil {
+		return err
+	}
+
+	if b.StartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return StartTLSMissingError
+		}
+		config := b.TLSConfig
+		if config == nil {
+			host, _, _ := net.SplitHostPort(b.Addr)
+			config = &tls.Config{ServerName: host}
+		}
+		if err := c.StartTLS(config); err != nil {
+			return err
+		}
+	}
+
+	if b.Auth != nil {
+		if err := c.Auth(b.Auth); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(m.From); err != nil {
+		return err
+	}
+	for _, to := range m.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(m.TimeStamp(b.host) + m.Data)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+
+}
+
+// upstreamReply turns an smtp error reply into a *ReplyError so the
+// client sees the upstream code.
+func upstreamReply(err error) error {
+	var te *textproto.Error
+	if errors.As(err, &te) {
+		return &ReplyError{Reply(te.Code), err}
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package helo
+
+import (
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	UpstreamTestHost = "127.0.0.1:9998"
+	RelayTestHost    = ":9999"
+)
+
+func TestRelayBackend(t *testing.T) {
+
+	upstream := NewSmtpServer(UpstreamTestHost)
+	upstream.SetStore(NewStore(0))
+	if err := upstream.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Stop()
+
+	rs := NewSmtpServer(RelayTestHost)
+	rs.SetBackend(NewRelayBackend(UpstreamTestHost))
+	if err := rs.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Stop()
+
+	err := smtp.SendMail(RelayTestHost, nil, "sender@example.org", []string{"recipient@example.net"}, []byte("Subject: relayed\r\n\r\nThis is the email body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := upstream.Store().WaitFor(MessageFilter{Subject: "relayed"}.Match, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.From != "sender@example.org" || m.To[0] != "recipient@example.net" {
+		t.Errorf("unexpected envelope %+v", m)
+	}
+	if !strings.HasPrefix(m.Data, "Received: from localhost (127.0.0.1:") || !strings.HasSuffix(m.Data, "\r\n\r\nThis is the email body") {
+		t.Errorf("unexpected data %q", m.Data)
+	}
+
+	// dot stuffed lines are unstuffed once on each hop
+	err = smtp.SendMail(RelayTestHost, nil, "sender@example.org", []string{"recipient@example.net"}, []byte("Subject: dotted\r\n\r\n.leading dot\r\n..\r\n.\r\nend"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = upstream.Store().WaitFor(MessageFilter{Subject: "dotted"}.Match, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(m.Data, "\r\n\r\n.leading dot\r\n..\r\n.\r\nend") {
+		t.Errorf("unexpected data %q", m.Data)
+	}
+
+	// bounces have the null reverse-path
+	err = smtp.SendMail(RelayTestHost, nil, "", []string{"recipient@example.net"}, []byte("Subject: bounced\r\n\r\nThis is the email body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = upstream.Store().WaitFor(MessageFilter{Subject: "bounced"}.Match, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.From != "" || !strings.HasPrefix(m.MailArg, "FROM:<>") {
+		t.Errorf("unexpected envelope %+v", m)
+	}
+
+	// upstream replies are passed through to the client
+	upstream.SetGreylist(NewGreylist(time.Hour))
+
+	err = smtp.SendMail(RelayTestHost, nil, "sender@example.org", []string{"recipient@example.net"}, []byte("This is the email body"))
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 451 {
+		t.Errorf("expected upstream 451, got %v", err)
+	}
+
+}
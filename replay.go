@@ -0,0 +1,196 @@
+package helo
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+type (
+	// Replayer plays the client side of a recorded transcript against
+	// the server at Addr and compares each of its replies with the one
+	// recorded, by reply code or with Exact set by the full text.
+	//
+	// TLS dials with implicit tls, as for a session recorded on an
+	// smtps server, and a recorded STARTTLS is repeated whenever the
+	// server accepts it.  Timing keeps the recorded pauses between
+	// client writes.
+	//
+	// AUTH credentials are recorded redacted, so a session that
+	// authenticated cannot be replayed past its AUTH.
+	Replayer struct {
+		Addr      string
+		TLS       bool
+		TLSConfig *tls.Config
+		Exact     bool
+		Timing    bool
+		Timeout   time.Duration
+	}
+	// ReplayDiff is a reply that did not match the recording, along
+	// with the client data it answers.
+	ReplayDiff struct {
+		Client   string `json:"client"`
+		Expected string `json:"expected"`
+		Got      string `json:"got"`
+	}
+)
+
+const (
+	DefaultReplayTimeout = 10 * time.Second
+)
+
+var (
+	ReplayRedactedError = errors.New("transcript has redacted credentials")
+)
+
+func NewReplayer(addr string) *Replayer {
+	return &Replayer{
+		Addr:    addr,
+		Timeout: DefaultReplayTimeout,
+	}
+}
+
+// Replay plays t and returns the replies that differ.  When DATA is
+// recorded as accepted but refused by the server, the message data
+// and its reply are skipped.  An error ends the replay early, as when
+// the server closes the connection before a recorded reply or with
+// ReplayRedactedError at redacted AUTH credentials.
+func (rp *Replayer) Replay(t *Transcript) ([]ReplayDiff, error) {
+
+	config := rp.TLSConfig
+	if config == nil {
+		host, _, _ := net.SplitHostPort(rp.Addr)
+		config = &tls.Config{ServerName: host}
+	}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if rp.TLS {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: rp.Timeout}, "tcp", rp.Addr, config)
+	} else {
+		conn, err = net.DialTimeout("tcp", rp.Addr, rp.Timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() { conn.Close() }()
+
+	var (
+		r        = bufio.NewReader(conn)
+		diffs    []ReplayDiff
+		client   string
+		expected string
+		last     time.Time
+		skip     bool // the data of a refused DATA and its reply
+	)
+
+	for _, e := range t.Entries() {
+
+		switch e.Direction {
+		case DirectionClient:
+			if skip {
+				continue
+			}
+			if isRedacted(e.Data) {
+				return diffs, ReplayRedactedError
+			}
+			if rp.Timing && !last.IsZero() {
+				time.Sleep(e.Time.Sub(last))
+			}
+			last = e.Time
+
+			conn.SetWriteDeadline(time.Now().Add(rp.Timeout))
+			if _, err := conn.Write([]byte(e.Data)); err != nil {
+				return diffs, err
+			}
+			client = e.Data
+
+		case DirectionServer:
+			// replies may be recorded a line at a time
+			expected += e.Data
+			if !finalReply(expected) {
+				continue
+			}
+			if skip {
+				skip = false
+				expected = ""
+				continue
+			}
+
+			conn.SetReadDeadline(time.Now().Add(rp.Timeout))
+			got, err := readReply(r)
+			if err != nil {
+				return diffs, err
+			}
+
+			if !rp.match(expected, got) {
+				diffs = append(diffs, ReplayDiff{client, expected, got})
+			}
+
+			// the server is not reading data, so it is not sent
+			if strings.EqualFold(strings.TrimSpace(client), CommandData) && replyCode(expected) == "354" && replyCode(got) != "354" {
+				skip = true
+			}
+
+			if strings.EqualFold(strings.TrimSpace(client), CommandStarttls) && strings.HasPrefix(got, "220") {
+				conn = tls.Client(conn, config)
+				r = bufio.NewReader(conn)
+			}
+
+			expected = ""
+		}
+
+	}
+
+	return diffs, nil
+
+}
+
+func (rp *Replayer) match(expected, got string) bool {
+	if rp.Exact {
+		return expected == got
+	}
+	return replyCode(expected) == replyCode(got)
+}
+
+// readReply reads lines up to and including the last line of a reply.
+func readReply(r *bufio.Reader) (string, error) {
+
+	var reply string
+
+	for {
+		line, err := r.ReadString('\n')
+		reply += line
+		if err != nil {
+			return reply, err
+		}
+		if finalReply(reply) {
+			return reply, nil
+		}
+	}
+
+}
+
+// finalReply reports whether the last line of reply ends it, that is
+// has no hyphen after the code.
+func finalReply(reply string) bool {
+	if !strings.HasSuffix(reply, "\n") {
+		return false
+	}
+	line := reply[strings.LastIndex(strings.TrimSuffix(reply, "\n"), "\n")+1:]
+	return len(line) >= 4 && line[3] != '-'
+}
+
+// replyCode returns the code of the last line of reply.
+func replyCode(reply string) string {
+	line := reply[strings.LastIndex(strings.TrimSuffix(reply, "\n"), "\n")+1:]
+	if len(line) < 3 {
+		return line
+	}
+	return line[:3]
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/jasonmoo/helo"
+)
+
+// Plays the client side of transcripts saved by a server run with
+// -transcript_dir against another server and reports every reply that
+// differs from the recording.
+//
+//	replay -addr mx.example.org:25 sessions/*.transcript
+var (
+	addr     = flag.String("addr", "localhost:25", "host:port of the server to replay against")
+	use_tls  = flag.Bool("tls", false, "connect with implicit tls, as for sessions recorded on smtps")
+	insecure = flag.Bool("insecure", false, "skip verifying the server certificate")
+	exact    = flag.Bool("exact", false, "compare the full reply text instead of reply codes")
+	timing   = flag.Bool("timing", false, "keep the recorded pauses between client writes")
+	timeout  = flag.Duration("timeout", helo.DefaultReplayTimeout, "timeout for each read and write")
+)
+
+func main() {
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		log.Fatal("usage: replay [flags] transcript...")
+	}
+
+	rp := helo.NewReplayer(*addr)
+	rp.TLS = *use_tls
+	rp.Exact = *exact
+	rp.Timing = *timing
+	rp.Timeout = *timeout
+	if *insecure {
+		rp.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	failed := false
+
+	for _, name := range flag.Args() {
+
+		diffs, err := replay(rp, name)
+		for _, d := range diffs {
+			fmt.Printf("%s: after %q\n  expected %q\n  got      %q\n", name, d.Client, d.Expected, d.Got)
+		}
+		if err != nil {
+			fmt.Printf("%s: %s\n", name, err)
+		}
+
+		if len(diffs) > 0 || err != nil {
+			failed = true
+		} else {
+			fmt.Printf("%s: ok\n", name)
+		}
+
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+
+}
+
+func replay(rp *helo.Replayer, name string) ([]helo.ReplayDiff, error) {
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	t, err := helo.ReadTranscript(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return rp.Replay(t)
+
+}
@@ -0,0 +1,109 @@
+package helo
+
+import (
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	ReplayRecordTestHost = "127.0.0.1:9985"
+	ReplayTargetTestHost = "127.0.0.1:9986"
+)
+
+func TestReplay(t *testing.T) {
+
+	dir := t.TempDir()
+
+	s := NewSmtpServer(ReplayRecordTestHost)
+	s.SetTranscriptDir(dir)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	err := smtp.SendMail(ReplayRecordTestHost, nil, "sender@example.org", []string{"recipient@example.net"}, []byte("Subject: replayed\r\n\r\n.This line starts with a dot\r\nThis is the email body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// saved once the server ends the session
+	var names []string
+	for deadline := time.Now().Add(time.Second); len(names) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		names, _ = filepath.Glob(filepath.Join(dir, "*.transcript"))
+	}
+	if len(names) != 1 {
+		t.Fatalf("expected a transcript file, got %v", names)
+	}
+
+	f, err := os.Open(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	transcript, err := ReadTranscript(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := transcript.Entries()
+	if len(entries) == 0 || entries[0].Direction != DirectionServer || !strings.Contains(entries[len(entries)-4].Data, "\r\n..This line starts with a dot\r\nThis is the email body\r\n.\r\n") {
+		t.Fatalf("unexpected transcript %+v", entries)
+	}
+
+	target := NewSmtpServer(ReplayTargetTestHost)
+	target.SetStore(NewStore(0))
+	if err := target.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer target.Stop()
+
+	rp := NewReplayer(ReplayTargetTestHost)
+	rp.Exact = true
+
+	diffs, err := rp.Replay(transcript)
+	if err != nil || len(diffs) != 0 {
+		t.Fatalf("expected a clean replay, got %v %+v", err, diffs)
+	}
+	// the data is replayed as sent, stuffed
+	if m := target.Store().Messages(); len(m) != 1 || m[0].Subject() != "replayed" || !strings.HasSuffix(m[0].Data, "\r\n\r\n.This line starts with a dot\r\nThis is the email body") {
+		t.Errorf("expected the replayed message delivered, got %v", m)
+	}
+
+	// a greylisting target answers RCPT differently, and so DATA, whose
+	// data is then not sent
+	target.SetGreylist(NewGreylist(time.Hour))
+
+	diffs, err = rp.Replay(transcript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct{ client, got string }{
+		{"RCPT", "451"},
+		{"DATA", "503"},
+	}
+	if len(diffs) != len(expected) {
+		t.Fatalf("expected %d diffs, got %+v", len(expected), diffs)
+	}
+	for i, e := range expected {
+		if !strings.HasPrefix(diffs[i].Client, e.client) || !strings.HasPrefix(diffs[i].Got, e.got) {
+			t.Errorf("expected diff %d to be %s answered with %s, got %+v", i, e.client, e.got, diffs[i])
+		}
+	}
+
+	// credentials are not replayed
+	authenticated := &Transcript{}
+	authenticated.record(DirectionServer, "220 helo Service ready\r\n")
+	authenticated.record(DirectionClient, "EHLO localhost\r\n")
+	authenticated.record(DirectionServer, "250 helo at your service\r\n")
+	authenticated.record(DirectionClient, "AUTH PLAIN <redacted>\r\n")
+	authenticated.record(DirectionServer, "235 Authentication succeeded\r\n")
+
+	if diffs, err := NewReplayer(ReplayTargetTestHost).Replay(authenticated); err != ReplayRedactedError || len(diffs) != 0 {
+		t.Errorf("expected a redacted error, got %v %+v", err, diffs)
+	}
+
+}
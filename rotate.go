@@ -0,0 +1,32 @@
+package helo
+
+import (
+	"time"
+)
+
+type (
+	// Rotation configures when a file sink starts a new file.  Zero
+	// values disable the respective limit.
+	Rotation struct {
+		MaxSize int64
+		MaxAge  time.Duration
+	}
+)
+
+const (
+	rotation_suffix_format = "20060102T150405.000000000"
+)
+
+func (r Rotation) due(size int64, started time.Time) bool {
+	if r.MaxSize > 0 && size >= r.MaxSize {
+		return true
+	}
+	if r.MaxAge > 0 && time.Since(started) >= r.MaxAge {
+		return true
+	}
+	return false
+}
+
+func (r Rotation) enabled() bool {
+	return r.MaxSize > 0 || r.MaxAge > 0
+}
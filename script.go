@@ -0,0 +1,168 @@
+package helo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Script replaces the default command handling with a fixed
+// conversation, one directive per line:
+//
+//	# comments and blank lines are ignored
+//	send 220-mx.example.com ESMTP
+//	send 220 ready
+//	expect EHLO
+//	send 250 mx.example.com
+//	expect MAIL
+//	raw "250 ok\n"
+//	expect *
+//	sleep 2s
+//	close
+//
+// send writes the rest of the line followed by CRLF, raw writes a go
+// quoted string as is, expect reads a command and requires its verb to
+// match (* matches any), data reads message data up to <CRLF>.<CRLF>,
+// sleep pauses and close ends the session.  The session also ends after
+// the last directive.
+type (
+	Script struct {
+		Steps []ScriptStep
+	}
+	ScriptStep struct {
+		Directive string
+		Arg       string
+		Line      int
+	}
+)
+
+const (
+	ScriptSend   = "send"
+	ScriptRaw    = "raw"
+	ScriptExpect = "expect"
+	ScriptData   = "data"
+	ScriptSleep  = "sleep"
+	ScriptClose  = "close"
+)
+
+func LoadScript(path string) (*Script, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseScript(f)
+
+}
+
+func ParseScript(r io.Reader) (*Script, error) {
+
+	var (
+		script  = &Script{}
+		scanner = bufio.NewScanner(r)
+		line    int
+	)
+
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		step := ScriptStep{Line: line}
+		if i := strings.IndexByte(text, ' '); i > -1 {
+			step.Directive, step.Arg = text[:i], strings.TrimSpace(text[i+1:])
+		} else {
+			step.Directive = text
+		}
+
+		switch step.Directive {
+		case ScriptSend:
+		case ScriptRaw:
+			arg, err := strconv.Unquote(step.Arg)
+			if err != nil {
+				return nil, fmt.Errorf("script line %d: raw requires a quoted string: %s", line, err)
+			}
+			step.Arg = arg
+		case ScriptExpect:
+			if len(step.Arg) == 0 {
+				return nil, fmt.Errorf("script line %d: expect requires a command", line)
+			}
+			step.Arg = strings.ToUpper(step.Arg)
+		case ScriptSleep:
+			if _, err := time.ParseDuration(step.Arg); err != nil {
+				return nil, fmt.Errorf("script line %d: %s", line, err)
+			}
+		case ScriptData, ScriptClose:
+			if len(step.Arg) > 0 {
+				return nil, fmt.Errorf("script line %d: %s takes no arguments", line, step.Directive)
+			}
+		default:
+			return nil, fmt.Errorf("script line %d: unknown directive %q", line, step.Directive)
+		}
+
+		script.Steps = append(script.Steps, step)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return script, nil
+
+}
+
+func (s *SmtpServer) runScript(r *Reader, w *Writer) {
+
+	for _, step := range s.script.Steps {
+
+		switch step.Directive {
+		case ScriptSend:
+			if err := w.WriteRaw(step.Arg + "\r\n"); err != nil {
+				r.c.log.Warn("script failed", "line", step.Line, "err", err)
+				return
+			}
+
+		case ScriptRaw:
+			if err := w.WriteRaw(step.Arg); err != nil {
+				r.c.log.Warn("script failed", "line", step.Line, "err", err)
+				return
+			}
+
+		case ScriptExpect:
+			command, _, err := r.ReadCommand()
+			if err != nil && err != BadSyntaxError {
+				r.c.log.Warn("script failed", "line", step.Line, "err", err)
+				return
+			}
+			if step.Arg != "*" && command != step.Arg {
+				r.c.log.Warn("script expectation failed", "line", step.Line, "expected", step.Arg, "got", command)
+				w.WriteReplyCode(ReplyBadSequenceOfCommands)
+				return
+			}
+
+		case ScriptData:
+			if _, err := r.ReadData(); err != nil {
+				r.c.log.Warn("script failed", "line", step.Line, "err", err)
+				return
+			}
+
+		case ScriptSleep:
+			d, _ := time.ParseDuration(step.Arg)
+			time.Sleep(d)
+
+		case ScriptClose:
+			return
+		}
+
+	}
+
+}
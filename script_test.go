@@ -0,0 +1,81 @@
+package helo
+
+import (
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+const (
+	ScriptTestHost = ":9994"
+
+	TestScript = `
+# multiline greeting and a quirky EHLO reply
+send 220-mx.example.com ESMTP
+send 220 welcome
+expect EHLO
+send 250 mx.example.com
+expect mail
+send 250 2.1.0 Ok
+expect RCPT
+raw "550 5.1.1 no such user\r\n"
+expect *
+send 221 bye
+`
+)
+
+func TestParseScript(t *testing.T) {
+
+	script, err := ParseScript(strings.NewReader(TestScript))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(script.Steps) != 10 {
+		t.Errorf("expected 10 steps, got %d", len(script.Steps))
+	}
+	if step := script.Steps[4]; step.Directive != ScriptExpect || step.Arg != "MAIL" || step.Line != 7 {
+		t.Errorf("unexpected step %+v", step)
+	}
+
+	for _, bad := range []string{"bogus", "expect", "raw 250 unquoted", "sleep forever", "close now"} {
+		if _, err := ParseScript(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected error parsing %q", bad)
+		}
+	}
+
+}
+
+func TestScriptedSession(t *testing.T) {
+
+	script, err := ParseScript(strings.NewReader(TestScript))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ss := NewSmtpServer(ScriptTestHost)
+	ss.SetScript(script)
+
+	if err := ss.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Stop()
+
+	c, err := smtp.Dial(ScriptTestHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Mail("sender@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	err = c.Rcpt("recipient@example.net")
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 550 || e.Msg != "5.1.1 no such user" {
+		t.Errorf("expected scripted 550, got %v", err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Error(err)
+	}
+
+}
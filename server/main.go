@@ -1,9 +1,21 @@
 package main
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"expvar"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
 	"runtime"
+	"strings"
 
 	"github.com/jasonmoo/helo"
 )
@@ -15,11 +27,56 @@ import (
 var (
 	dev = flag.Bool("dev", false, "output dev signals")
 
+	log_format = flag.String("log_format", "", "structured log output, text or json, instead of the plain log")
+	log_level  = flag.String("log_level", "info", "structured log level: debug logs every line, or info, warn, error")
+
 	smtp_host  = flag.String("smtp_host", ":25", "host:port to listen on")
 	smtps_host = flag.String("smtps_host", ":465", "host:port to listen on")
+	lmtp_host  = flag.String("lmtp_host", "", "host:port to listen on for lmtp")
+
+	submission_host  = flag.String("submission_host", "", "host:port to listen on for message submission, eg :587")
+	submission_users = flag.String("submission_users", "", "comma separated user:password pairs allowed to submit")
 
 	tls_cert = flag.String("tls_cert", "cert/cert.pem", "cert for tls server")
 	tls_key  = flag.String("tls_key", "cert/key.pem", "key for tls server")
+
+	greylist       = flag.Bool("greylist", false, "answer 451 to the first attempt of each client ip, sender and recipient")
+	greylist_delay = flag.Duration("greylist_delay", helo.DefaultGreylistDelay, "how long before a greylisted retry is accepted")
+
+	script = flag.String("script", "", "play this script in every session instead of the default command handling")
+
+	maildir = flag.String("maildir", "", "deliver accepted messages into maildirs under this path")
+	mbox    = flag.String("mbox", "", "append accepted messages to this mbox file")
+	eml_dir = flag.String("eml_dir", "", "write accepted messages as .eml files into this directory")
+
+	rotate_size = flag.Int64("rotate_size", 0, "rotate mbox/eml output after this many bytes")
+	rotate_age  = flag.Duration("rotate_age", 0, "rotate mbox/eml output after this long")
+
+	webhook        = flag.String("webhook", "", "post accepted messages as json to this url")
+	webhook_wait   = flag.Bool("webhook_wait", false, "wait for the webhook before replying to the end of data")
+	webhook_parsed = flag.Bool("webhook_parsed", false, "post the parsed message instead of the raw data")
+
+	relay_host     = flag.String("relay_host", "", "forward accepted messages to this upstream host:port")
+	relay_starttls = flag.Bool("relay_starttls", false, "require STARTTLS with the upstream")
+	relay_user     = flag.String("relay_user", "", "user for PLAIN auth with the upstream")
+	relay_password = flag.String("relay_password", "", "password for PLAIN auth with the upstream")
+	relay_async    = flag.Bool("relay_async", false, "accept messages before relaying them from a queue, implied by -queue_dir")
+	queue_dir      = flag.String("queue_dir", "", "queue relayed messages on disk in this directory, retrying failed deliveries")
+
+	primary    = flag.String("primary", "", "with several destinations, the one deciding the reply: maildir, mbox, eml, webhook or relay")
+	tee_relays = flag.String("tee_relays", "", "comma separated host:ports that get a copy of every message")
+
+	journal = flag.String("journal", "", "append a json line per transaction to this file")
+
+	trace = flag.String("trace", "", "export a trace of every session as json lines to this file, - for stdout")
+
+	transcript_dir = flag.String("transcript_dir", "", "save the transcript of every session to a file in this directory, for replay")
+
+	api_host = flag.String("api_host", "", "host:port to serve the http inspection api on")
+
+	metrics_host = flag.String("metrics_host", "", "host:port to serve prometheus metrics on at /metrics")
+
+	debug_host = flag.String("debug_host", "", "host:port to serve sessions in progress and expvar on at /debug/")
 )
 
 func main() {
@@ -29,8 +86,134 @@ func main() {
 
 	s := helo.NewSmtpServer(*smtp_host)
 	ss := helo.NewSmtpsServer(*smtps_host, *tls_cert, *tls_key)
+	ls := helo.NewLmtpServer(*lmtp_host)
+	ms := helo.NewSmtpServer(*submission_host)
 
-	err := s.Start()
+	if *log_format != "" {
+		logger, err := slogger()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, server := range []*helo.SmtpServer{s, ss.SmtpServer, ls, ms} {
+			server.SetSlogger(logger)
+		}
+	}
+
+	if *submission_host != "" {
+		sub, err := submission()
+		if err != nil {
+			log.Fatal(err)
+		}
+		ms.SetSubmission(sub)
+	}
+
+	b, err := backend()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if b != nil {
+		s.SetBackend(b)
+		ss.SetBackend(b)
+		ls.SetBackend(b)
+		ms.SetBackend(b)
+	}
+
+	if *script != "" {
+		sc, err := helo.LoadScript(*script)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, server := range []*helo.SmtpServer{s, ss.SmtpServer, ls, ms} {
+			server.SetScript(sc)
+		}
+	}
+
+	if *greylist {
+		g := helo.NewGreylist(*greylist_delay)
+		s.SetGreylist(g)
+		ss.SetGreylist(g)
+	}
+
+	if *journal != "" {
+		j, err := helo.OpenJournal(*journal)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.SetJournal(j)
+		ss.SetJournal(j)
+		ls.SetJournal(j)
+		ms.SetJournal(j)
+	}
+
+	if *transcript_dir != "" {
+		if err := os.MkdirAll(*transcript_dir, 0700); err != nil {
+			log.Fatal(err)
+		}
+		for _, server := range []*helo.SmtpServer{s, ss.SmtpServer, ls, ms} {
+			server.SetTranscriptDir(*transcript_dir)
+		}
+	}
+
+	if *trace != "" {
+		w := io.Writer(os.Stdout)
+		if *trace != "-" {
+			f, err := os.OpenFile(*trace, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				log.Fatal(err)
+			}
+			w = f
+		}
+		exporter := helo.NewJSONSpanExporter(w)
+		for _, server := range []*helo.SmtpServer{s, ss.SmtpServer, ls, ms} {
+			server.SetSpanExporter(exporter)
+		}
+	}
+
+	if *api_host != "" {
+		store := helo.NewStore(0)
+		s.SetStore(store)
+		ss.SetStore(store)
+		ls.SetStore(store)
+		ms.SetStore(store)
+		if err := s.StartAPI(*api_host); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *metrics_host != "" {
+		metrics := helo.NewMetrics()
+		for _, server := range []*helo.SmtpServer{s, ss.SmtpServer, ls, ms} {
+			server.SetMetrics(metrics)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		go func() {
+			log.Fatal(http.ListenAndServe(*metrics_host, mux))
+		}()
+	}
+
+	if *debug_host != "" {
+		registry := helo.NewRegistry()
+		servers := map[string]*helo.SmtpServer{"smtp": s, "smtps": ss.SmtpServer, "lmtp": ls, "submission": ms}
+		for _, server := range servers {
+			server.SetRegistry(registry)
+		}
+		expvar.Publish("sessions", expvar.Func(func() interface{} { return registry.Sessions() }))
+		expvar.Publish("stats", expvar.Func(func() interface{} {
+			stats := make(map[string]helo.ServerStats)
+			for name, server := range servers {
+				stats[name] = server.Stats()
+			}
+			return stats
+		}))
+		mux := http.NewServeMux()
+		mux.Handle("/debug/", registry)
+		go func() {
+			log.Fatal(http.ListenAndServe(*debug_host, mux))
+		}()
+	}
+
+	err = s.Start()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -40,7 +223,179 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if *lmtp_host != "" {
+		if err := ls.Start(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *submission_host != "" {
+		if err := ms.Start(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	log.Println("server starting up")
 	select {}
 
 }
+
+func slogger() (*slog.Logger, error) {
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*log_level)); err != nil {
+		return nil, err
+	}
+	options := &slog.HandlerOptions{Level: level}
+
+	switch *log_format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stdout, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stdout, options)), nil
+	}
+	return nil, fmt.Errorf("-log_format %q is not text or json", *log_format)
+
+}
+
+func submission() (*helo.Submission, error) {
+
+	certificate, err := tls.LoadX509KeyPair(*tls_cert, *tls_key)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]string)
+	for _, pair := range strings.Split(*submission_users, ",") {
+		if pair = strings.TrimSpace(pair); pair != "" {
+			user, password, ok := strings.Cut(pair, ":")
+			if !ok {
+				return nil, fmt.Errorf("-submission_users: %q is not user:password", pair)
+			}
+			users[user] = password
+		}
+	}
+
+	return helo.NewSubmission(&tls.Config{Certificates: []tls.Certificate{certificate}}, func(user, password string) bool {
+		p, ok := users[user]
+		return ok && subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+	}), nil
+
+}
+
+func backend() (helo.Backend, error) {
+
+	// destinations by name, see -primary
+	backends := make(map[string]helo.Backend)
+
+	rotation := helo.Rotation{
+		MaxSize: *rotate_size,
+		MaxAge:  *rotate_age,
+	}
+
+	if *maildir != "" {
+		b, err := helo.NewMaildirBackend(*maildir)
+		if err != nil {
+			return nil, err
+		}
+		backends["maildir"] = b
+	}
+
+	if *mbox != "" {
+		b, err := helo.NewMboxBackend(*mbox)
+		if err != nil {
+			return nil, err
+		}
+		b.Rotation = rotation
+		backends["mbox"] = b
+	}
+
+	if *eml_dir != "" {
+		b, err := helo.NewEmlBackend(*eml_dir)
+		if err != nil {
+			return nil, err
+		}
+		b.Rotation = rotation
+		backends["eml"] = b
+	}
+
+	if *webhook != "" {
+		b := helo.NewWebhookBackend(*webhook)
+		b.Wait = *webhook_wait
+		b.Parsed = *webhook_parsed
+		b.Logger = log.New(os.Stderr, "", log.LstdFlags)
+		backends["webhook"] = b
+	}
+
+	if *relay_host != "" {
+		b := helo.NewRelayBackend(*relay_host)
+		b.StartTLS = *relay_starttls
+		// the queue needs the upstream reply to retry or bounce, and
+		// already answers the client before relaying
+		b.Async = *relay_async && *queue_dir == ""
+		b.Logger = log.New(os.Stderr, "", log.LstdFlags)
+		if *relay_user != "" {
+			host, _, _ := net.SplitHostPort(*relay_host)
+			b.Auth = smtp.PlainAuth("", *relay_user, *relay_password, host)
+		}
+		backends["relay"] = b
+
+		if *queue_dir != "" {
+			q, err := helo.NewQueue(*queue_dir, b)
+			if err != nil {
+				return nil, err
+			}
+			q.Logger = b.Logger
+			if err := q.Start(); err != nil {
+				return nil, err
+			}
+			backends["relay"] = q
+		}
+	}
+
+	var secondaries []helo.Backend
+
+	for _, host := range strings.Split(*tee_relays, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			b := helo.NewRelayBackend(host)
+			b.Async = true
+			b.Logger = log.New(os.Stderr, "", log.LstdFlags)
+			secondaries = append(secondaries, b)
+		}
+	}
+
+	name := *primary
+	if name == "" && len(backends) == 1 {
+		for n := range backends {
+			name = n
+		}
+	}
+
+	p, ok := backends[name]
+	switch {
+	case len(backends) == 0 && len(secondaries) == 0:
+		return nil, nil
+	case len(backends) == 0:
+		return nil, errors.New("-tee_relays needs a primary destination")
+	case name == "":
+		return nil, errors.New("-primary must be set when sending to several destinations")
+	case !ok:
+		return nil, fmt.Errorf("-primary %q is not configured", name)
+	}
+
+	for n, b := range backends {
+		if n != name {
+			secondaries = append(secondaries, b)
+		}
+	}
+
+	if len(secondaries) == 0 {
+		return p, nil
+	}
+
+	tee := helo.NewTeeBackend(p, secondaries...)
+	tee.Logger = log.New(os.Stderr, "", log.LstdFlags)
+
+	return tee, nil
+
+}
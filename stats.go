@@ -0,0 +1,172 @@
+package helo
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+type (
+	// SessionStats is where the time of one session went.
+	SessionStats struct {
+		ID           string         `json:"id"`
+		RemoteAddr   string         `json:"remote_addr"`
+		Started      time.Time      `json:"started"`
+		Duration     time.Duration  `json:"duration"`
+		Greeting     time.Duration  `json:"greeting"`      // from accepting to the greeting written
+		TLSHandshake time.Duration  `json:"tls_handshake"` // implicit or after STARTTLS
+		Commands     []CommandStats `json:"commands"`
+		Messages     int            `json:"messages"`
+		DataBytes    int64          `json:"data_bytes"`
+		DataDuration time.Duration  `json:"data_duration"` // reading message data
+		BytesIn      int64          `json:"bytes_in"`
+		BytesOut     int64          `json:"bytes_out"`
+		Outcome      string         `json:"outcome"`
+	}
+	// CommandStats is one command round trip, from reading the command
+	// to writing the last line of its reply.  The end of data reply is
+	// timed from the end of the data.
+	CommandStats struct {
+		Verb     string        `json:"verb"`
+		Code     int           `json:"code"`
+		Duration time.Duration `json:"duration"`
+	}
+	// ServerStats aggregates every session ended since the server was
+	// created, along with the most recent ones.
+	ServerStats struct {
+		Sessions     int                      `json:"sessions"`
+		Outcomes     map[string]int           `json:"outcomes"`
+		Commands     map[string]CommandTotals `json:"commands"`
+		Messages     int                      `json:"messages"`
+		DataBytes    int64                    `json:"data_bytes"`
+		DataDuration time.Duration            `json:"data_duration"`
+		BytesIn      int64                    `json:"bytes_in"`
+		BytesOut     int64                    `json:"bytes_out"`
+		Recent       []SessionStats           `json:"recent"`
+	}
+	CommandTotals struct {
+		Count int           `json:"count"`
+		Total time.Duration `json:"total"`
+		Max   time.Duration `json:"max"`
+	}
+	serverStats struct {
+		mu       sync.Mutex
+		stats    ServerStats
+		callback func(*SessionStats)
+	}
+)
+
+const (
+	RecentSessions = 100
+)
+
+// SetSessionCallback calls f with the stats of every session as it
+// ends, from the session's goroutine.
+func (s *SmtpServer) SetSessionCallback(f func(*SessionStats)) {
+	s.stats.mu.Lock()
+	s.stats.callback = f
+	s.stats.mu.Unlock()
+}
+
+// Stats returns totals over every session ended so far and the stats
+// of the last RecentSessions, most recent last.
+func (s *SmtpServer) Stats() ServerStats {
+
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+
+	stats := s.stats.stats
+	stats.Outcomes = make(map[string]int, len(s.stats.stats.Outcomes))
+	for outcome, n := range s.stats.stats.Outcomes {
+		stats.Outcomes[outcome] = n
+	}
+	stats.Commands = make(map[string]CommandTotals, len(s.stats.stats.Commands))
+	for verb, totals := range s.stats.stats.Commands {
+		stats.Commands[verb] = totals
+	}
+	stats.Recent = append([]SessionStats(nil), s.stats.stats.Recent...)
+
+	return stats
+
+}
+
+// DataThroughput is the rate message data was read at in bytes per
+// second.
+func (ss *SessionStats) DataThroughput() float64 {
+	if ss.DataDuration <= 0 {
+		return 0
+	}
+	return float64(ss.DataBytes) / ss.DataDuration.Seconds()
+}
+
+// replied records the round trip of the command c is answering once
+// its last reply line is written.
+func (c *session) replied(data string) {
+
+	c.mu.Lock()
+	c.stats.BytesOut += int64(len(data))
+	c.mu.Unlock()
+
+	if c.verb == "" || len(data) < 4 || data[3] == '-' {
+		return
+	}
+	code, err := strconv.Atoi(data[:3])
+	if err != nil {
+		return
+	}
+
+	verb := c.verb
+	if !known_verbs[verb] {
+		verb = "other"
+	}
+
+	c.stats.Commands = append(c.stats.Commands, CommandStats{verb, code, time.Since(c.since)})
+	c.trace.command(verb, c.since, data[:3])
+
+}
+
+func (s *SmtpServer) endSession(c *session, outcome string) {
+
+	stats := &c.stats
+	stats.Duration = time.Since(stats.Started)
+	stats.Outcome = outcome
+
+	s.stats.mu.Lock()
+
+	total := &s.stats.stats
+	if total.Outcomes == nil {
+		total.Outcomes = make(map[string]int)
+		total.Commands = make(map[string]CommandTotals)
+	}
+
+	total.Sessions++
+	total.Outcomes[outcome]++
+	for _, command := range stats.Commands {
+		totals := total.Commands[command.Verb]
+		totals.Count++
+		totals.Total += command.Duration
+		if command.Duration > totals.Max {
+			totals.Max = command.Duration
+		}
+		total.Commands[command.Verb] = totals
+	}
+	total.Messages += stats.Messages
+	total.DataBytes += stats.DataBytes
+	total.DataDuration += stats.DataDuration
+	total.BytesIn += stats.BytesIn
+	total.BytesOut += stats.BytesOut
+
+	if len(total.Recent) >= RecentSessions {
+		total.Recent = append(total.Recent[:0], total.Recent[1:]...)
+	}
+	total.Recent = append(total.Recent, *stats)
+
+	callback := s.stats.callback
+
+	s.stats.mu.Unlock()
+
+	if callback != nil {
+		callback(stats)
+	}
+
+}
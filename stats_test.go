@@ -0,0 +1,81 @@
+package helo
+
+import (
+	"net/smtp"
+	"testing"
+	"time"
+)
+
+const (
+	StatsTestHost = ":9987"
+)
+
+func TestStats(t *testing.T) {
+
+	ended := make(chan SessionStats, 2)
+
+	s := NewSmtpServer(StatsTestHost)
+	s.SetSessionCallback(func(ss *SessionStats) { ended <- *ss })
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	body := []byte("This is the email body")
+
+	for i := 0; i < 2; i++ {
+		if err := smtp.SendMail(StatsTestHost, nil, "sender@example.org", []string{"recipient@example.net"}, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case ss := <-ended:
+			if ss.Outcome != OutcomeQuit {
+				t.Errorf("expected outcome %q, got %q", OutcomeQuit, ss.Outcome)
+			}
+			if ss.Messages != 1 {
+				t.Errorf("expected 1 message, got %d", ss.Messages)
+			}
+			// the body as sent plus the line ending and terminating dot
+			if ss.DataBytes < int64(len(body)) {
+				t.Errorf("expected at least %d data bytes, got %d", len(body), ss.DataBytes)
+			}
+			if ss.BytesIn == 0 || ss.BytesOut == 0 || ss.Greeting <= 0 || ss.Duration < ss.Greeting {
+				t.Errorf("unexpected stats %+v", ss)
+			}
+			var verbs []string
+			for _, c := range ss.Commands {
+				verbs = append(verbs, c.Verb)
+			}
+			expected := []string{"EHLO", "MAIL", "RCPT", "DATA", "DATA", "QUIT"}
+			if len(verbs) != len(expected) {
+				t.Fatalf("expected commands %v, got %v", expected, verbs)
+			}
+			for j, verb := range expected {
+				if verbs[j] != verb {
+					t.Errorf("expected commands %v, got %v", expected, verbs)
+					break
+				}
+			}
+			if ss.Commands[3].Code != 354 || ss.Commands[4].Code != 250 {
+				t.Errorf("expected DATA codes 354 and 250, got %d and %d", ss.Commands[3].Code, ss.Commands[4].Code)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("session callback not called")
+		}
+	}
+
+	stats := s.Stats()
+	if stats.Sessions != 2 || stats.Outcomes[OutcomeQuit] != 2 || stats.Messages != 2 {
+		t.Errorf("unexpected totals %+v", stats)
+	}
+	if totals := stats.Commands["DATA"]; totals.Count != 4 || totals.Max <= 0 || totals.Total < totals.Max {
+		t.Errorf("unexpected DATA totals %+v", totals)
+	}
+	if len(stats.Recent) != 2 || stats.Recent[0].ID == stats.Recent[1].ID {
+		t.Errorf("expected 2 distinct recent sessions, got %d", len(stats.Recent))
+	}
+
+}
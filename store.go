@@ -0,0 +1,232 @@
+package helo
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// Store keeps the most recent completed messages in memory.  Once
+	// size messages are stored the oldest is dropped for each new one.
+	Store struct {
+		size int
+
+		mu          sync.Mutex
+		messages    []*Message
+		next        uint64
+		arrived     chan struct{}
+		subscribers map[chan *Message]struct{}
+	}
+	// MessageFilter matches messages by case insensitive substrings of
+	// the sender, any recipient and the subject.  Empty fields match
+	// every message.
+	MessageFilter struct {
+		From    string
+		To      string
+		Subject string
+	}
+)
+
+const (
+	DefaultStoreSize = 1000
+)
+
+var (
+	WaitTimeoutError = errors.New("timed out waiting for message")
+)
+
+func NewStore(size int) *Store {
+	if size <= 0 {
+		size = DefaultStoreSize
+	}
+	return &Store{
+		size:        size,
+		arrived:     make(chan struct{}),
+		subscribers: make(map[chan *Message]struct{}),
+	}
+}
+
+// Add stores the message, assigning it an id if it has none.
+func (st *Store) Add(m *Message) {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.next++
+	if len(m.ID) == 0 {
+		m.ID = strconv.FormatUint(st.next, 10)
+	}
+
+	st.messages = append(st.messages, m)
+	if len(st.messages) > st.size {
+		st.messages[0] = nil
+		st.messages = st.messages[1:]
+	}
+
+	// wake up anyone waiting on a new message
+	close(st.arrived)
+	st.arrived = make(chan struct{})
+
+	for ch := range st.subscribers {
+		select {
+		case ch <- m:
+		default:
+			// slow subscribers miss messages rather than block delivery
+		}
+	}
+
+}
+
+// Subscribe returns a channel receiving each message added from now
+// on and a func to cancel the subscription.  Messages are dropped for
+// a subscriber whose buffer is full.
+func (st *Store) Subscribe(buffer int) (<-chan *Message, func()) {
+
+	ch := make(chan *Message, buffer)
+
+	st.mu.Lock()
+	st.subscribers[ch] = struct{}{}
+	st.mu.Unlock()
+
+	var once sync.Once
+
+	return ch, func() {
+		once.Do(func() {
+			st.mu.Lock()
+			delete(st.subscribers, ch)
+			st.mu.Unlock()
+		})
+	}
+
+}
+
+// Messages returns all stored messages, oldest first.
+func (st *Store) Messages() []*Message {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return append([]*Message(nil), st.messages...)
+}
+
+func (st *Store) Find(predicate func(*Message) bool) []*Message {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	var found []*Message
+	for _, m := range st.messages {
+		if predicate(m) {
+			found = append(found, m)
+		}
+	}
+
+	return found
+
+}
+
+func (st *Store) Filter(filter MessageFilter) []*Message {
+	return st.Find(filter.Match)
+}
+
+func (st *Store) Get(id string) (*Message, bool) {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for _, m := range st.messages {
+		if m.ID == id {
+			return m, true
+		}
+	}
+
+	return nil, false
+
+}
+
+func (st *Store) Delete(id string) bool {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for i, m := range st.messages {
+		if m.ID == id {
+			st.messages = append(st.messages[:i], st.messages[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+
+}
+
+func (st *Store) Clear() {
+	st.mu.Lock()
+	st.messages = nil
+	st.mu.Unlock()
+}
+
+func (st *Store) Len() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.messages)
+}
+
+// WaitFor returns the first stored message matching predicate,
+// blocking until one arrives or timeout elapses.
+func (st *Store) WaitFor(predicate func(*Message) bool, timeout time.Duration) (*Message, error) {
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		st.mu.Lock()
+		arrived := st.arrived
+		for _, m := range st.messages {
+			if predicate(m) {
+				st.mu.Unlock()
+				return m, nil
+			}
+		}
+		st.mu.Unlock()
+
+		select {
+		case <-arrived:
+		case <-timer.C:
+			return nil, WaitTimeoutError
+		}
+	}
+
+}
+
+func (f MessageFilter) Match(m *Message) bool {
+
+	if len(f.From) > 0 && !containsFold(m.From, f.From) {
+		return false
+	}
+
+	if len(f.To) > 0 {
+		var found bool
+		for _, to := range m.To {
+			if containsFold(to, f.To) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.Subject) > 0 && !containsFold(m.Subject(), f.Subject) {
+		return false
+	}
+
+	return true
+
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
@@ -0,0 +1,106 @@
+package helo
+
+import (
+	"net/smtp"
+	"testing"
+	"time"
+)
+
+const (
+	StoreTestHost = ":9995"
+)
+
+func TestStore(t *testing.T) {
+
+	st := NewStore(2)
+
+	st.Add(&Message{From: "a@example.org", To: []string{"x@example.net"}, Data: "Subject: first\r\n\r\nbody"})
+	st.Add(&Message{From: "b@example.org", To: []string{"y@example.net"}, Data: "Subject: second\r\n\r\nbody"})
+	st.Add(&Message{From: "c@example.org", To: []string{"x@example.net", "z@example.net"}, Data: "Subject: Third\r\n\r\nbody"})
+
+	messages := st.Messages()
+	if len(messages) != 2 || messages[0].ID != "2" || messages[1].ID != "3" {
+		t.Fatalf("expected messages 2 and 3, got %+v", messages)
+	}
+
+	if found := st.Filter(MessageFilter{To: "X@example.net"}); len(found) != 1 || found[0].ID != "3" {
+		t.Errorf("unexpected recipient filter result %+v", found)
+	}
+	if found := st.Filter(MessageFilter{Subject: "third"}); len(found) != 1 {
+		t.Errorf("unexpected subject filter result %+v", found)
+	}
+	if found := st.Filter(MessageFilter{From: "b@", Subject: "third"}); len(found) != 0 {
+		t.Errorf("unexpected combined filter result %+v", found)
+	}
+
+	if _, ok := st.Get("2"); !ok {
+		t.Error("expected to get message 2")
+	}
+	if !st.Delete("2") || st.Len() != 1 {
+		t.Error("expected to delete message 2")
+	}
+
+	st.Clear()
+	if st.Len() != 0 {
+		t.Error("expected empty store")
+	}
+
+	if _, err := st.WaitFor(MessageFilter{}.Match, 10*time.Millisecond); err != WaitTimeoutError {
+		t.Errorf("expected timeout, got %v", err)
+	}
+
+}
+
+func TestStoreWaitFor(t *testing.T) {
+
+	ms := NewSmtpServer(StoreTestHost)
+	ms.SetStore(NewStore(0))
+
+	if err := ms.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer ms.Stop()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		msg := "Subject: hello\r\n\r\nThis is the email body"
+		err := smtp.SendMail(StoreTestHost, nil, "sender@example.org", []string{"one@example.net", "two@example.net"}, []byte(msg))
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	m, err := ms.Store().WaitFor(MessageFilter{To: "two@example.net", Subject: "hello"}.Match, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.From != "sender@example.org" || len(m.To) != 2 {
+		t.Errorf("unexpected envelope %+v", m)
+	}
+	if got := m.Data; got != "Subject: hello\r\n\r\nThis is the email body" {
+		t.Errorf("unexpected data %q", got)
+	}
+
+	// the client stuffs the leading dot, the store keeps the line as sent
+	go func() {
+		msg := "Subject: dotted\r\n\r\n.This line starts with a dot"
+		if err := smtp.SendMail(StoreTestHost, nil, "sender@example.org", []string{"one@example.net"}, []byte(msg)); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	dotted, err := ms.Store().WaitFor(MessageFilter{Subject: "dotted"}.Match, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dotted.Data; got != "Subject: dotted\r\n\r\n.This line starts with a dot" {
+		t.Errorf("unexpected data %q", got)
+	}
+
+	entries := m.Transcript.Entries()
+	if len(entries) == 0 || entries[0].Direction != DirectionServer || entries[0].Data != "220 helo Service ready\r\n" {
+		t.Errorf("unexpected transcript %+v", entries)
+	}
+
+}
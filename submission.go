@@ -0,0 +1,177 @@
+package helo
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+)
+
+type (
+	// Submission makes a server behave as a message submission agent
+	// (RFC 6409): STARTTLS with TLSConfig is offered, AUTH PLAIN and
+	// LOGIN only once the session is encrypted, and MAIL only once
+	// authenticated, for a sender the identity may use.  With
+	// FixHeaders set, messages missing a Date or Message-ID header
+	// have one added.
+	//
+	// Fields must be set before the server is started.
+	Submission struct {
+		TLSConfig    *tls.Config
+		Authenticate Authenticator
+		// Sender reports whether identity may send as from, by
+		// default when the two are equal.
+		Sender     func(identity, from string) bool
+		FixHeaders bool
+
+		host string
+	}
+	Authenticator func(username, password string) bool
+)
+
+var (
+	AuthCancelledError = errors.New("authentication cancelled")
+)
+
+func NewSubmission(config *tls.Config, authenticate Authenticator) *Submission {
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+
+	return &Submission{
+		TLSConfig:    config,
+		Authenticate: authenticate,
+		FixHeaders:   true,
+		host:         host,
+	}
+
+}
+
+func (s *SmtpServer) SetSubmission(submission *Submission) {
+	s.submission = submission
+}
+
+func (sub *Submission) allowed(identity, from string) bool {
+	if sub.Sender != nil {
+		return sub.Sender(identity, from)
+	}
+	return strings.EqualFold(identity, from)
+}
+
+// fixHeaders adds the Date and Message-ID headers a submission agent
+// may supply when the client left them out.  Data that does not parse
+// as a message is left alone.
+func (sub *Submission) fixHeaders(data string) string {
+
+	m, err := mail.ReadMessage(strings.NewReader(data))
+	if err != nil {
+		return data
+	}
+
+	var missing string
+	if m.Header.Get("Message-Id") == "" {
+		missing += fmt.Sprintf("Message-ID: <%d.%s@%s>\r\n", time.Now().UnixNano(), newSessionID(), sub.host)
+	}
+	if m.Header.Get("Date") == "" {
+		missing += "Date: " + time.Now().Format(time.RFC1123Z) + "\r\n"
+	}
+
+	return missing + data
+
+}
+
+// authenticate runs an AUTH exchange, writing the final reply, and
+// returns the authenticated identity or "" on failure.
+func (s *SmtpServer) authenticate(r *Reader, w *Writer, arg string) string {
+
+	mechanism, initial, _ := strings.Cut(arg, " ")
+
+	var (
+		username, password string
+		err                error
+	)
+
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		// [authzid] NUL authcid NUL passwd, RFC 4616
+		var response string
+		if initial != "" {
+			response, err = decodeAuth(initial)
+		} else {
+			response, err = challenge(r, w, "")
+		}
+		if err != nil {
+			break
+		}
+		fields := strings.Split(response, "\x00")
+		if len(fields) != 3 || (fields[0] != "" && fields[0] != fields[1]) {
+			err = BadSyntaxError
+			break
+		}
+		username, password = fields[1], fields[2]
+
+	case "LOGIN":
+		if initial != "" {
+			username, err = decodeAuth(initial)
+		} else {
+			username, err = challenge(r, w, "Username:")
+		}
+		if err != nil {
+			break
+		}
+		password, err = challenge(r, w, "Password:")
+
+	default:
+		w.WriteReply(ReplyCommandParameterNotImplemented, "Unrecognized authentication type")
+		return ""
+	}
+
+	switch {
+	case err == AuthCancelledError:
+		w.WriteReply(ReplySyntaxErrorInParametersOrArguments, "Authentication cancelled")
+	case err != nil:
+		w.WriteReplyCode(ReplySyntaxErrorInParametersOrArguments)
+	case s.submission.Authenticate == nil || !s.submission.Authenticate(username, password):
+		w.WriteReplyCode(ReplyAuthenticationCredentialsInvalid)
+	default:
+		w.WriteReplyCode(ReplyAuthenticationSucceeded)
+		return username
+	}
+
+	return ""
+
+}
+
+// challenge sends a 334 with prompt and decodes the client's response.
+func challenge(r *Reader, w *Writer, prompt string) (string, error) {
+
+	if err := w.WriteReplyCode(ReplyServerChallenge, base64.StdEncoding.EncodeToString([]byte(prompt))); err != nil {
+		return "", err
+	}
+
+	line, err := r.readSecret()
+	if err != nil {
+		return "", err
+	}
+	if line == "*" {
+		return "", AuthCancelledError
+	}
+
+	return decodeAuth(line)
+
+}
+
+func decodeAuth(s string) (string, error) {
+	// a lone "=" is an empty initial response, RFC 4954
+	if s == "=" {
+		return "", nil
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	return string(b), err
+}
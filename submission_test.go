@@ -0,0 +1,180 @@
+package helo
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+const (
+	SubmissionTestHost = "127.0.0.1:9982"
+)
+
+type loginAuth struct {
+	username, password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(challenge []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch string(challenge) {
+	case "Username:":
+		return []byte(a.username), nil
+	case "Password:":
+		return []byte(a.password), nil
+	}
+	return nil, errors.New("unexpected challenge " + string(challenge))
+}
+
+func TestSubmission(t *testing.T) {
+
+	certificate, err := tls.LoadX509KeyPair(Cert, Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs syncBuffer
+
+	s := NewSmtpServer(SubmissionTestHost)
+	s.SetStore(NewStore(0))
+	s.SetSlogger(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	s.SetSubmission(NewSubmission(&tls.Config{Certificates: []tls.Certificate{certificate}}, func(username, password string) bool {
+		return username == "sender@example.org" && password == "secret"
+	}))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	dial := func() *smtp.Client {
+		t.Helper()
+		c, err := smtp.Dial(SubmissionTestHost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	code := func(err error) int {
+		if e, ok := err.(*textproto.Error); ok {
+			return e.Code
+		}
+		return 0
+	}
+
+	c := dial()
+	defer c.Close()
+
+	// no MAIL or AUTH in the clear
+	if err := c.Mail("sender@example.org"); code(err) != 530 {
+		t.Errorf("expected 530 before auth, got %v", err)
+	}
+	if ok, _ := c.Extension("AUTH"); ok {
+		t.Error("AUTH advertised before STARTTLS")
+	}
+	id, err := c.Text.Cmd("AUTH PLAIN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Text.StartResponse(id)
+	if _, _, err := c.Text.ReadResponse(538); err != nil {
+		t.Errorf("expected 538 before STARTTLS, got %v", err)
+	}
+	c.Text.EndResponse(id)
+
+	if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, mechanisms := c.Extension("AUTH"); !ok || mechanisms != "PLAIN LOGIN" {
+		t.Errorf("unexpected AUTH extension %q", mechanisms)
+	}
+	if err := c.Auth(smtp.PlainAuth("", "sender@example.org", "secret", "127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the sender must be the authenticated identity
+	if err := c.Mail("someone@example.org"); code(err) != 553 {
+		t.Errorf("expected 553 for another sender, got %v", err)
+	}
+	if err := c.Mail("sender@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("recipient@example.net"); err != nil {
+		t.Fatal(err)
+	}
+	wc, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wc.Write([]byte("Subject: submitted\r\n\r\nThis is the email body")); err != nil {
+		t.Fatal(err)
+	}
+	if err := wc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+
+	m := s.Store().Messages()[0]
+	header, err := m.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("Date") == "" || !strings.HasSuffix(header.Get("Message-Id"), ">") || m.Subject() != "submitted" {
+		t.Errorf("expected Date and Message-ID fixed up, got %q", m.Data)
+	}
+
+	// LOGIN
+	c = dial()
+	defer c.Close()
+	if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Auth(&loginAuth{"sender@example.org", "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail("SENDER@example.org"); err != nil {
+		t.Error(err)
+	}
+
+	// net/smtp gives up on the session after a failed AUTH
+	c = dial()
+	defer c.Close()
+	if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Auth(smtp.PlainAuth("", "sender@example.org", "wrong", "127.0.0.1")); code(err) != 535 {
+		t.Errorf("expected 535 for bad credentials, got %v", err)
+	}
+
+	// neither the PLAIN initial response nor the LOGIN responses are
+	// logged or recorded
+	var transcript strings.Builder
+	for _, entry := range m.Transcript.Entries() {
+		transcript.WriteString(entry.Data)
+	}
+	if !strings.Contains(transcript.String(), "AUTH PLAIN <redacted>\r\n") {
+		t.Errorf("expected a redacted AUTH in the transcript, got %q", transcript.String())
+	}
+	for _, secret := range []string{
+		base64.StdEncoding.EncodeToString([]byte("\x00sender@example.org\x00secret")),
+		base64.StdEncoding.EncodeToString([]byte("sender@example.org")),
+		base64.StdEncoding.EncodeToString([]byte("secret")),
+	} {
+		if strings.Contains(transcript.String(), secret) || strings.Contains(logs.String(), secret) {
+			t.Errorf("%s logged", secret)
+		}
+	}
+	if !strings.Contains(logs.String(), "data=\"<redacted>\\r\\n\"") {
+		t.Errorf("expected redacted LOGIN responses, got %s", logs.String())
+	}
+
+}
@@ -0,0 +1,50 @@
+package helo
+
+import (
+	"log"
+	"sync"
+)
+
+type (
+	// TeeBackend delivers each message to Primary, whose result
+	// decides the client reply, and copies it to each of Secondaries
+	// in the background regardless of that result.  Secondary failures
+	// are only logged.
+	TeeBackend struct {
+		Primary     Backend
+		Secondaries []Backend
+		Logger      *log.Logger
+
+		wg sync.WaitGroup
+	}
+)
+
+func NewTeeBackend(primary Backend, secondaries ...Backend) *TeeBackend {
+	return &TeeBackend{
+		Primary:     primary,
+		Secondaries: secondaries,
+	}
+}
+
+func (b *TeeBackend) Deliver(m *Message) error {
+
+	for _, secondary := range b.Secondaries {
+		// a copy, as the server goes on to modify m once delivered
+		c := *m
+		b.wg.Add(1)
+		go func(secondary Backend) {
+			defer b.wg.Done()
+			if err := secondary.Deliver(&c); err != nil && b.Logger != nil {
+				b.Logger.Printf("tee: secondary %T: %s", secondary, err)
+			}
+		}(secondary)
+	}
+
+	return b.Primary.Deliver(m)
+
+}
+
+// Wait blocks until every secondary delivery started so far is done.
+func (b *TeeBackend) Wait() {
+	b.wg.Wait()
+}
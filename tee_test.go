@@ -0,0 +1,50 @@
+package helo
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestTeeBackend(t *testing.T) {
+
+	var (
+		mu     sync.Mutex
+		copies []*Message
+	)
+
+	secondary := BackendFunc(func(m *Message) error {
+		mu.Lock()
+		copies = append(copies, m)
+		mu.Unlock()
+		return nil
+	})
+	failing := BackendFunc(func(m *Message) error {
+		return errors.New("secondary down")
+	})
+	primary := BackendFunc(func(m *Message) error {
+		return &ReplyError{ReplyTransactionFailed, errors.New("primary rejected")}
+	})
+
+	b := NewTeeBackend(primary, secondary, failing, secondary)
+
+	m := testMessage()
+	if err := b.Deliver(m); replyFor(err) != ReplyTransactionFailed {
+		t.Errorf("expected the primary reply, got %v", err)
+	}
+	b.Wait()
+
+	if len(copies) != 2 {
+		t.Fatalf("expected 2 copies, got %d", len(copies))
+	}
+	if copies[0] == m || copies[0].Data != m.Data {
+		t.Errorf("expected a copy of the message, got %+v", copies[0])
+	}
+
+	b.Primary = BackendFunc(func(m *Message) error { return nil })
+	if err := b.Deliver(m); err != nil {
+		t.Errorf("expected secondary failures to be ignored, got %v", err)
+	}
+	b.Wait()
+
+}
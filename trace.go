@@ -0,0 +1,233 @@
+package helo
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TRACING
+//
+// With an exporter set each session is a trace in the shape used by
+// OpenTelemetry: a root span for the connection with a child for the
+// tls handshake, one for each command from reading it to the last line
+// of its reply, and one for reading message data.  Spans are exported
+// as they end, so the root comes last.
+//
+// A message carrying a W3C traceparent in its TraceContextHeader has
+// its data span linked to the span given there, as a client would to
+// tie its send to the receive.
+//
+//	X-Trace-Context: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+
+type (
+	// Span is one timed operation of a session.  Ids are hex, as in a
+	// traceparent.
+	Span struct {
+		TraceID    string            `json:"trace_id"`
+		SpanID     string            `json:"span_id"`
+		ParentID   string            `json:"parent_id,omitempty"`
+		Name       string            `json:"name"`
+		Start      time.Time         `json:"start"`
+		End        time.Time         `json:"end"`
+		Attributes map[string]string `json:"attributes,omitempty"`
+		Links      []SpanLink        `json:"links,omitempty"`
+		Error      string            `json:"error,omitempty"`
+	}
+	SpanLink struct {
+		TraceID string `json:"trace_id"`
+		SpanID  string `json:"span_id"`
+	}
+	// SpanExporter receives each span as it ends, from the goroutine of
+	// its session.
+	SpanExporter interface {
+		ExportSpan(span *Span) error
+	}
+	// SpanExporterFunc adapts a func to a SpanExporter.
+	SpanExporterFunc func(span *Span) error
+	// JSONSpanExporter writes spans to a writer as json, one per line.
+	JSONSpanExporter struct {
+		mu sync.Mutex
+		w  io.Writer
+	}
+	// sessionTrace is the trace of one session, nil when not tracing.
+	sessionTrace struct {
+		exporter SpanExporter
+		log      *slog.Logger
+		root     *Span
+	}
+)
+
+const (
+	TraceContextHeader = "X-Trace-Context"
+)
+
+func (f SpanExporterFunc) ExportSpan(span *Span) error {
+	return f(span)
+}
+
+func NewJSONSpanExporter(w io.Writer) *JSONSpanExporter {
+	return &JSONSpanExporter{w: w}
+}
+
+func (e *JSONSpanExporter) ExportSpan(span *Span) error {
+
+	data, err := json.Marshal(span)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	_, err = e.w.Write(data)
+	return err
+
+}
+
+// SetSpanExporter traces every session to exporter.
+func (s *SmtpServer) SetSpanExporter(exporter SpanExporter) {
+	s.exporter = exporter
+}
+
+func (s *SmtpServer) newSessionTrace(c *session) *sessionTrace {
+
+	if s.exporter == nil {
+		return nil
+	}
+
+	return &sessionTrace{
+		exporter: s.exporter,
+		log:      c.log,
+		root: &Span{
+			TraceID: newTraceID(16),
+			SpanID:  newTraceID(8),
+			Name:    "smtp.session",
+			Start:   c.stats.Started,
+			Attributes: map[string]string{
+				"session":     c.id,
+				"remote_addr": c.stats.RemoteAddr,
+			},
+		},
+	}
+
+}
+
+// record exports a child of the session span from start until now.
+func (t *sessionTrace) record(name string, start time.Time, attributes map[string]string, err error, links ...SpanLink) {
+
+	if t == nil {
+		return
+	}
+
+	span := &Span{
+		TraceID:    t.root.TraceID,
+		SpanID:     newTraceID(8),
+		ParentID:   t.root.SpanID,
+		Name:       name,
+		Start:      start,
+		End:        time.Now(),
+		Attributes: attributes,
+		Links:      links,
+	}
+	if err != nil {
+		span.Error = err.Error()
+	}
+
+	t.export(span)
+
+}
+
+// data records reading message data, linked to the client's span when
+// the message carries one.
+func (t *sessionTrace) data(start time.Time, data string, err error) {
+
+	if t == nil {
+		return
+	}
+
+	attributes := map[string]string{"size": strconv.Itoa(len(data))}
+
+	var links []SpanLink
+	if err == nil {
+		if m, merr := mail.ReadMessage(strings.NewReader(data)); merr == nil {
+			if link, ok := parseTraceparent(m.Header.Get(TraceContextHeader)); ok {
+				links = append(links, link)
+			}
+		}
+	}
+
+	t.record("smtp.data", start, attributes, err, links...)
+
+}
+
+// command records answering a command with a reply code.
+func (t *sessionTrace) command(verb string, start time.Time, code string) {
+
+	if t == nil {
+		return
+	}
+
+	t.record("smtp "+verb, start, map[string]string{"code": code}, nil)
+
+}
+
+// end exports the session span.
+func (t *sessionTrace) end(outcome string) {
+
+	if t == nil {
+		return
+	}
+
+	t.root.End = time.Now()
+	t.root.Attributes["outcome"] = outcome
+	t.export(t.root)
+
+}
+
+func (t *sessionTrace) export(span *Span) {
+	if err := t.exporter.ExportSpan(span); err != nil {
+		t.log.Warn("span export failed", "span", span.Name, "err", err)
+	}
+}
+
+// parseTraceparent returns the span of a W3C traceparent value,
+// version-traceid-spanid-flags.
+func parseTraceparent(value string) (SpanLink, bool) {
+
+	fields := strings.Split(strings.TrimSpace(value), "-")
+	if len(fields) < 4 || len(fields[0]) != 2 || fields[0] == "ff" {
+		return SpanLink{}, false
+	}
+
+	link := SpanLink{TraceID: strings.ToLower(fields[1]), SpanID: strings.ToLower(fields[2])}
+	if !validTraceID(link.TraceID, 32) || !validTraceID(link.SpanID, 16) {
+		return SpanLink{}, false
+	}
+
+	return link, true
+
+}
+
+// validTraceID reports whether id is n hex digits and not all zero.
+func validTraceID(id string, n int) bool {
+	if len(id) != n || strings.Trim(id, "0") == "" {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func newTraceID(n int) string {
+	id := make([]byte, n)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
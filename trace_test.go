@@ -0,0 +1,113 @@
+package helo
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/smtp"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	TraceTestHost = ":9988"
+)
+
+func TestTrace(t *testing.T) {
+
+	var (
+		mu    sync.Mutex
+		spans []*Span
+		ended = make(chan struct{})
+	)
+
+	s := NewSmtpServer(TraceTestHost)
+	s.SetSpanExporter(SpanExporterFunc(func(span *Span) error {
+		mu.Lock()
+		spans = append(spans, span)
+		mu.Unlock()
+		if span.Name == "smtp.session" {
+			close(ended)
+		}
+		return nil
+	}))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	body := []byte("X-Trace-Context: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\n\r\nThis is the email body")
+	if err := smtp.SendMail(TraceTestHost, nil, "sender@example.org", []string{"recipient@example.net"}, body); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-ended:
+	case <-time.After(time.Second):
+		t.Fatal("session span not exported")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	root := spans[len(spans)-1]
+	if root.ParentID != "" || root.Attributes["outcome"] != OutcomeQuit || root.End.Before(root.Start) {
+		t.Errorf("unexpected session span %+v", root)
+	}
+
+	var names []string
+	for _, span := range spans[:len(spans)-1] {
+		if span.TraceID != root.TraceID || span.ParentID != root.SpanID {
+			t.Errorf("span %s not a child of the session", span.Name)
+		}
+		names = append(names, span.Name)
+		if span.Name == "smtp.data" {
+			if len(span.Links) != 1 || span.Links[0] != (SpanLink{"4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"}) {
+				t.Errorf("expected a link to the client span, got %v", span.Links)
+			}
+		}
+	}
+
+	expected := []string{"smtp EHLO", "smtp MAIL", "smtp RCPT", "smtp DATA", "smtp.data", "smtp DATA", "smtp QUIT"}
+	if len(names) != len(expected) {
+		t.Fatalf("expected spans %v, got %v", expected, names)
+	}
+	for i, name := range expected {
+		if names[i] != name {
+			t.Errorf("expected spans %v, got %v", expected, names)
+			break
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := NewJSONSpanExporter(&buf).ExportSpan(root); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Span
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.SpanID != root.SpanID || buf.Bytes()[buf.Len()-1] != '\n' {
+		t.Errorf("unexpected json span %q", buf.String())
+	}
+
+}
+
+func TestParseTraceparent(t *testing.T) {
+
+	for value, ok := range map[string]bool{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01": true,
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-00": true,
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01": false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01": false,
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01": false,
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01":  false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902bz-01": false,
+		"": false,
+	} {
+		if _, got := parseTraceparent(value); got != ok {
+			t.Errorf("parseTraceparent(%q) = %t, expected %t", value, got, ok)
+		}
+	}
+
+}
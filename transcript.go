@@ -0,0 +1,141 @@
+package helo
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// Transcript records both sides of a session as they happen.
+	Transcript struct {
+		mu      sync.Mutex
+		entries []TranscriptEntry
+	}
+	TranscriptEntry struct {
+		Time      time.Time `json:"time"`
+		Direction Direction `json:"direction"`
+		Data      string    `json:"data"`
+	}
+	Direction string
+)
+
+const (
+	DirectionClient Direction = "<<<"
+	DirectionServer Direction = ">>>"
+
+	transcript_time_format = "2006-01-02T15:04:05.000000000Z07:00"
+)
+
+var (
+	TranscriptSyntaxError = errors.New("transcript syntax error")
+)
+
+// SetTranscriptDir saves the transcript of every session to its own
+// file in dir once the session ends, named for its start time and
+// session id.  The files can be read back with ReadTranscript and
+// played against a server with a Replayer.  AUTH credentials are
+// recorded as <redacted>, so replays stop at them.
+func (s *SmtpServer) SetTranscriptDir(dir string) {
+	s.transcriptDir = dir
+}
+
+func (s *SmtpServer) saveTranscript(c *session, t *Transcript) {
+
+	entries := t.Entries()
+	if s.transcriptDir == "" || len(entries) == 0 {
+		return
+	}
+
+	var buf bytes.Buffer
+	t.WriteTo(&buf)
+
+	name := filepath.Join(s.transcriptDir, entries[0].Time.UTC().Format("20060102T150405.000000")+"-"+c.id+".transcript")
+	if err := writeFileAtomic(name, buf.Bytes()); err != nil {
+		c.log.Warn("saving transcript failed", "err", err)
+	}
+
+}
+
+func (t *Transcript) record(direction Direction, data string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.entries = append(t.entries, TranscriptEntry{time.Now(), direction, data})
+	t.mu.Unlock()
+}
+
+// WriteTo writes the transcript one entry per line: the time, the
+// direction and the data quoted as a Go string, so that every byte
+// survives.
+func (t *Transcript) WriteTo(w io.Writer) (int64, error) {
+
+	var total int64
+
+	for _, e := range t.Entries() {
+		n, err := fmt.Fprintf(w, "%s %s %s\n", e.Time.Format(transcript_time_format), e.Direction, strconv.Quote(e.Data))
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+
+}
+
+// ReadTranscript reads a transcript written by WriteTo.
+func ReadTranscript(r io.Reader) (*Transcript, error) {
+
+	t := &Transcript{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 4*MaxMessageSize)
+
+	for line := 1; scanner.Scan(); line++ {
+
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: %w", line, TranscriptSyntaxError)
+		}
+
+		ts, err := time.Parse(transcript_time_format, fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		direction := Direction(fields[1])
+		if direction != DirectionClient && direction != DirectionServer {
+			return nil, fmt.Errorf("line %d: %w", line, TranscriptSyntaxError)
+		}
+
+		data, err := strconv.Unquote(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, TranscriptSyntaxError)
+		}
+
+		t.entries = append(t.entries, TranscriptEntry{ts, direction, data})
+
+	}
+
+	return t, scanner.Err()
+
+}
+
+// Entries returns a copy of everything recorded so far.
+func (t *Transcript) Entries() []TranscriptEntry {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]TranscriptEntry(nil), t.entries...)
+}
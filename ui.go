@@ -0,0 +1,33 @@
+package helo
+
+import (
+	"embed"
+	"net/http"
+)
+
+var (
+	//go:embed ui/index.html
+	ui_files embed.FS
+)
+
+// serveUI serves the self contained web ui, which talks to the
+// inspection api and loads nothing from anywhere else.
+func serveUI(w http.ResponseWriter, r *http.Request) {
+
+	if r.URL.Path != "/" && r.URL.Path != "/index.html" {
+		http.NotFound(w, r)
+		return
+	}
+
+	index, err := ui_files.ReadFile("ui/index.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; frame-src 'self'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(index)
+
+}
@@ -0,0 +1,226 @@
+package helo
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type (
+	// WebhookBackend POSTs each message as json to URL from a bounded
+	// queue, retrying failed requests with exponential backoff.
+	//
+	// When Wait is set the end of data reply waits for the webhook: a
+	// 4xx response other than 408 and 429 fails the message with a
+	// 554, anything else still failing after the retries with a 451.
+	// Otherwise messages are accepted as soon as they are queued and
+	// failures are only logged.  Either way a full queue is answered
+	// with a 451.
+	//
+	// Fields must be set before the first Deliver.
+	WebhookBackend struct {
+		URL         string
+		Client      *http.Client
+		Parsed      bool
+		Wait        bool
+		QueueSize   int
+		Concurrency int
+		Retries     int
+		Backoff     time.Duration
+		MaxBackoff  time.Duration
+		Logger      *log.Logger
+
+		once  sync.Once
+		queue chan *webhookJob
+		wg    sync.WaitGroup
+	}
+	webhookJob struct {
+		message *Message
+		result  chan error
+	}
+	// WebhookPayload is the body posted for each message, holding the
+	// raw data or, with Parsed set, the parsed message.
+	WebhookPayload struct {
+		Envelope Envelope        `json:"envelope"`
+		Raw      string          `json:"raw,omitempty"`
+		Parsed   *WebhookMessage `json:"parsed,omitempty"`
+	}
+	WebhookMessage struct {
+		Header      map[string][]string `json:"header"`
+		Text        string              `json:"text"`
+		HTML        string              `json:"html"`
+		Attachments []Attachment        `json:"attachments"`
+	}
+	webhookStatusError struct {
+		status int
+	}
+)
+
+const (
+	DefaultWebhookQueueSize   = 1000
+	DefaultWebhookConcurrency = 4
+	DefaultWebhookRetries     = 3
+	DefaultWebhookBackoff     = 500 * time.Millisecond
+	DefaultWebhookMaxBackoff  = 30 * time.Second
+	DefaultWebhookTimeout     = 10 * time.Second
+)
+
+var (
+	WebhookQueueFullError = errors.New("webhook queue full")
+)
+
+func NewWebhookBackend(url string) *WebhookBackend {
+	return &WebhookBackend{
+		URL:         url,
+		Client:      &http.Client{Timeout: DefaultWebhookTimeout},
+		QueueSize:   DefaultWebhookQueueSize,
+		Concurrency: DefaultWebhookConcurrency,
+		Retries:     DefaultWebhookRetries,
+		Backoff:     DefaultWebhookBackoff,
+		MaxBackoff:  DefaultWebhookMaxBackoff,
+	}
+}
+
+func (b *WebhookBackend) start() {
+	b.queue = make(chan *webhookJob, b.QueueSize)
+	for i := 0; i < b.Concurrency; i++ {
+		b.wg.Add(1)
+		go b.work()
+	}
+}
+
+func (b *WebhookBackend) Deliver(m *Message) error {
+
+	b.once.Do(b.start)
+
+	// a copy, as the server goes on to modify m once delivered
+	c := *m
+	job := &webhookJob{message: &c}
+	if b.Wait {
+		job.result = make(chan error, 1)
+	}
+
+	select {
+	case b.queue <- job:
+	default:
+		return &ReplyError{ReplyRequestedActionAbortedInProcessing, WebhookQueueFullError}
+	}
+
+	if !b.Wait {
+		return nil
+	}
+
+	err := <-job.result
+	if err == nil {
+		return nil
+	}
+
+	var se *webhookStatusError
+	if errors.As(err, &se) && se.permanent() {
+		return &ReplyError{ReplyTransactionFailed, err}
+	}
+	return &ReplyError{ReplyRequestedActionAbortedInProcessing, err}
+
+}
+
+// Close waits for queued messages to be posted and stops the workers.
+// Deliver must not be called after Close.
+func (b *WebhookBackend) Close() {
+	b.once.Do(b.start)
+	close(b.queue)
+	b.wg.Wait()
+}
+
+func (b *WebhookBackend) work() {
+
+	defer b.wg.Done()
+
+	for job := range b.queue {
+		err := b.post(job.message)
+		if job.result != nil {
+			job.result <- err
+		} else if err != nil {
+			b.logf("webhook: %s", err)
+		}
+	}
+
+}
+
+func (b *WebhookBackend) post(m *Message) error {
+
+	payload := &WebhookPayload{Envelope: m.Envelope()}
+
+	if b.Parsed {
+		parsed, err := m.Parse()
+		if err != nil {
+			return err
+		}
+		payload.Parsed = &WebhookMessage{parsed.Header, parsed.Text, parsed.HTML, parsed.Attachments}
+	} else {
+		payload.Raw = m.Data
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	backoff := b.Backoff
+
+	for attempt := 0; ; attempt++ {
+
+		err = b.request(body)
+
+		var se *webhookStatusError
+		if err == nil || (errors.As(err, &se) && se.permanent()) || attempt >= b.Retries {
+			return err
+		}
+
+		b.logf("webhook: attempt %d failed, retrying in %s: %s", attempt+1, backoff, err)
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > b.MaxBackoff {
+			backoff = b.MaxBackoff
+		}
+
+	}
+
+}
+
+func (b *WebhookBackend) request(body []byte) error {
+
+	res, err := b.Client.Post(b.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &webhookStatusError{res.StatusCode}
+	}
+
+	return nil
+
+}
+
+func (b *WebhookBackend) logf(format string, args ...interface{}) {
+	if b.Logger != nil {
+		b.Logger.Printf(format, args...)
+	}
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("webhook responded %d %s", e.status, http.StatusText(e.status))
+}
+
+// permanent reports whether retrying cannot help.
+func (e *webhookStatusError) permanent() bool {
+	return e.status >= 400 && e.status < 500 && e.status != http.StatusRequestTimeout && e.status != http.StatusTooManyRequests
+}
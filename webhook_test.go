@@ -0,0 +1,86 @@
+package helo
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookBackend(t *testing.T) {
+
+	var (
+		attempts int32
+		status   int32 = http.StatusOK
+		payloads       = make(chan WebhookPayload, 10)
+	)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		var payload WebhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+		payloads <- payload
+	}))
+	defer ts.Close()
+
+	b := NewWebhookBackend(ts.URL)
+	b.Wait = true
+	b.Parsed = true
+	b.Retries = 2
+	b.Backoff = time.Millisecond
+	defer b.Close()
+
+	if err := b.Deliver(testMessage()); err != nil {
+		t.Fatal(err)
+	}
+	payload := <-payloads
+	if payload.Envelope.From != "sender@example.org" || payload.Parsed == nil || payload.Parsed.Text != "From here\r\n>From there\r\nnot From" {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+
+	atomic.StoreInt32(&attempts, 0)
+	atomic.StoreInt32(&status, http.StatusBadRequest)
+	if err := b.Deliver(testMessage()); replyFor(err) != ReplyTransactionFailed || atomic.LoadInt32(&attempts) != 1 {
+		t.Errorf("expected a single attempt and 554, got %d attempts and %v", attempts, err)
+	}
+	<-payloads
+
+	atomic.StoreInt32(&attempts, 0)
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	if err := b.Deliver(testMessage()); replyFor(err) != ReplyRequestedActionAbortedInProcessing || atomic.LoadInt32(&attempts) != 3 {
+		t.Errorf("expected 3 attempts and 451, got %d attempts and %v", attempts, err)
+	}
+
+}
+
+func TestWebhookBackendAsync(t *testing.T) {
+
+	payloads := make(chan WebhookPayload, 1)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload WebhookPayload
+		json.NewDecoder(r.Body).Decode(&payload)
+		payloads <- payload
+	}))
+	defer ts.Close()
+
+	b := NewWebhookBackend(ts.URL)
+
+	m := testMessage()
+	if err := b.Deliver(m); err != nil {
+		t.Fatal(err)
+	}
+	// as a store does while the webhook is posted
+	m.ID = "1"
+	b.Close()
+
+	if payload := <-payloads; payload.Raw != testMessage().Data || payload.Envelope.ID != "" {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+
+}
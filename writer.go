@@ -1,15 +1,21 @@
 package helo
 
 import (
+	"bufio"
 	"fmt"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
 )
 
 type (
 	Writer struct {
 		net.Conn
 		s *SmtpServer
+		c *session
+		t *Transcript
+		b *bufio.Writer
 	}
 	Reply int
 )
@@ -19,8 +25,10 @@ const (
 	ReplyHelpMessage                                         Reply = 214
 	ReplyServiceReady                                        Reply = 220
 	ReplyServiceClosingTransmissionChannel                   Reply = 221
+	ReplyAuthenticationSucceeded                             Reply = 235
 	ReplyOk                                                  Reply = 250
 	ReplyUserNotLocalWillForwardTo                           Reply = 251
+	ReplyServerChallenge                                     Reply = 334
 	ReplyStartMailInputEndWith                               Reply = 354
 	ReplyServiceNotAvailable                                 Reply = 421
 	ReplyRequestedMailActionNotTakenMailboxUnavailable       Reply = 450
@@ -35,6 +43,9 @@ const (
 	ReplyUserNotLocalPleaseTry                               Reply = 551
 	ReplyRequestedMailActionAbortedExceededStorageAllocation Reply = 552
 	ReplyRequestedActionNotTakenMailboxNameNotAllowed        Reply = 553
+	ReplyAuthenticationRequired                              Reply = 530
+	ReplyAuthenticationCredentialsInvalid                    Reply = 535
+	ReplyEncryptionRequired                                  Reply = 538
 	ReplyTransactionFailed                                   Reply = 554
 )
 
@@ -42,12 +53,14 @@ var (
 	// REPLY CODES
 	// http://tools.ietf.org/html/rfc821#page-35
 	reply_codes = map[Reply]string{
-		ReplySystemReply:                       "211 System status, or system help reply\r\n",
-		ReplyHelpMessage:                       "214 http://www.google.com/search?btnI&q=RFC+2821\r\n",
-		ReplyServiceReady:                      "220 helo Service ready\r\n",
-		ReplyServiceClosingTransmissionChannel: "221 helo Service closing transmission channel\r\n",
-		ReplyOk: "250 OK\r\n",
+		ReplySystemReply:                                         "211 System status, or system help reply\r\n",
+		ReplyHelpMessage:                                         "214 http://www.google.com/search?btnI&q=RFC+2821\r\n",
+		ReplyServiceReady:                                        "220 helo Service ready\r\n",
+		ReplyServiceClosingTransmissionChannel:                   "221 helo Service closing transmission channel\r\n",
+		ReplyAuthenticationSucceeded:                             "235 Authentication successful\r\n",
+		ReplyOk:                                                  "250 OK\r\n",
 		ReplyUserNotLocalWillForwardTo:                           "251 User not local; will forward to %s\r\n",
+		ReplyServerChallenge:                                     "334 %s\r\n",
 		ReplyStartMailInputEndWith:                               "354 Start mail input; end with <CRLF>.<CRLF>\r\n",
 		ReplyServiceNotAvailable:                                 "421 helo Service not available\r\n",                           // closing transmission channel [This may be a reply to any command if the service knows it must shut down]
 		ReplyRequestedMailActionNotTakenMailboxUnavailable:       "450 Requested mail action not taken: mailbox unavailable\r\n", // [E.g., mailbox busy]
@@ -62,30 +75,107 @@ var (
 		ReplyUserNotLocalPleaseTry:                               "551 User not local; please try %s\r\n",
 		ReplyRequestedMailActionAbortedExceededStorageAllocation: "552 Requested mail action aborted: exceeded storage allocation\r\n",
 		ReplyRequestedActionNotTakenMailboxNameNotAllowed:        "553 Requested action not taken: mailbox name not allowed\r\n", // Requested action not taken: mailbox name not allowed
+		ReplyAuthenticationRequired:                              "530 Authentication required\r\n",
+		ReplyAuthenticationCredentialsInvalid:                    "535 Authentication credentials invalid\r\n",
+		ReplyEncryptionRequired:                                  "538 Encryption required for requested authentication mechanism\r\n",
 		ReplyTransactionFailed:                                   "554 Transaction failed\r\n",
 	}
+	reply_classes = map[Reply]string{
+		2: "OK",
+		3: "Continue",
+		4: "Requested action not taken: temporary failure",
+		5: "Requested action not taken: permanent failure",
+	}
+	// replies that take no arguments, written as they are
+	reply_lines = literalReplies(reply_codes)
+
+	writer_pool = sync.Pool{New: func() interface{} { return bufio.NewWriterSize(nil, writer_size) }}
 )
 
+const (
+	writer_size = 1 << 10
+)
+
+func (s *SmtpServer) newWriter(conn net.Conn, c *session, t *Transcript) *Writer {
+	bw := writer_pool.Get().(*bufio.Writer)
+	bw.Reset(conn)
+	return &Writer{conn, s, c, t, bw}
+}
+
+// release returns the buffer of w to the pool, after which w is not
+// to be used.
+func (w *Writer) release() {
+	w.b.Reset(nil)
+	writer_pool.Put(w.b)
+	w.b = nil
+}
+
 func (w *Writer) WriteReplyCode(code Reply, args ...interface{}) error {
-	if w.s.logger != nil {
-		w.s.logf(">>> %q", fmt.Sprintf(reply_codes[code], args...))
+	if line, ok := reply_lines[code]; ok && len(args) == 0 {
+		return w.WriteRaw(line)
 	}
-	_, err := fmt.Fprintf(w, reply_codes[code], args...)
-	return err
+	format, ok := reply_codes[code]
+	if !ok {
+		// codes passed through from elsewhere, eg an upstream server
+		return w.WriteReply(code, reply_classes[code/100])
+	}
+	return w.WriteRaw(fmt.Sprintf(format, args...))
 }
 
 func (w *Writer) WriteReply(code Reply, message string, args ...interface{}) error {
-	if w.s.logger != nil {
-		w.s.logf(">>> %q", fmt.Sprintf(strconv.Itoa(int(code))+" "+message+"\r\n", args...))
-	}
-	_, err := fmt.Fprintf(w, strconv.Itoa(int(code))+" "+message+"\r\n", args...)
-	return err
+	return w.write(replyLine(code, ' ', message, args), true)
 }
 
+// WriteContinuedReply writes a line of a multiline reply, which is
+// sent along with the last.
 func (w *Writer) WriteContinuedReply(code Reply, message string, args ...interface{}) error {
-	if w.s.logger != nil {
-		w.s.logf(">>> %q", fmt.Sprintf(strconv.Itoa(int(code))+"-"+message+"\r\n", args...))
+	return w.write(replyLine(code, '-', message, args), false)
+}
+
+func (w *Writer) WriteRaw(data string) error {
+	return w.write(data, true)
+}
+
+func (w *Writer) write(data string, flush bool) error {
+
+	w.c.traffic(DirectionServer, data)
+	w.t.record(DirectionServer, data)
+	w.s.metrics.reply(w.c, data)
+	w.c.replied(data)
+
+	if _, err := w.b.WriteString(data); err != nil {
+		return err
+	}
+	if !flush {
+		return nil
+	}
+	return w.b.Flush()
+
+}
+
+// replyLine formats a reply line, only going through fmt when there
+// is something to format.
+func replyLine(code Reply, separator byte, message string, args []interface{}) string {
+
+	line := make([]byte, 0, 128)
+	line = strconv.AppendInt(line, int64(code), 10)
+	line = append(line, separator)
+	line = append(line, message...)
+	line = append(line, "\r\n"...)
+
+	if len(args) == 0 && strings.IndexByte(message, '%') < 0 {
+		return string(line)
+	}
+	return fmt.Sprintf(string(line), args...)
+
+}
+
+func literalReplies(codes map[Reply]string) map[Reply]string {
+	lines := make(map[Reply]string)
+	for code, format := range codes {
+		if !strings.Contains(format, "%") {
+			lines[code] = format
+		}
 	}
-	_, err := fmt.Fprintf(w, strconv.Itoa(int(code))+"-"+message+"\r\n", args...)
-	return err
+	return lines
 }